@@ -0,0 +1,99 @@
+package automerge_s3_sync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// AEADMode is an authenticated cipher that ClientEncryptedS3 can seal object data with. The Name is recorded in the
+// cipher-mode metadata of each object so that reads can select the matching mode, and New must accept a 32 byte key.
+type AEADMode struct {
+	Name string
+	New  func(key []byte) (cipher.AEAD, error)
+}
+
+var (
+	// AEADModeAESGCM is AES-256-GCM with a random 12 byte nonce. This is the default.
+	AEADModeAESGCM = AEADMode{Name: "GCM", New: newAESGCM}
+	// AEADModeChaCha20Poly1305 is ChaCha20-Poly1305 with a random 12 byte nonce, for clients without AES hardware
+	// acceleration.
+	AEADModeChaCha20Poly1305 = AEADMode{Name: "CHACHA20-POLY1305", New: chacha20poly1305.New}
+	// AEADModeXChaCha20Poly1305 is XChaCha20-Poly1305 with a random 24 byte nonce, which makes nonce collisions
+	// negligible even for many messages under one key.
+	AEADModeXChaCha20Poly1305 = AEADMode{Name: "XCHACHA20-POLY1305", New: chacha20poly1305.NewX}
+)
+
+var builtinAEADModes = []AEADMode{AEADModeAESGCM, AEADModeChaCha20Poly1305, AEADModeXChaCha20Poly1305}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	if block, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	} else {
+		return cipher.NewGCM(block)
+	}
+}
+
+// sizes returns the nonce size and overhead of the mode.
+func (m AEADMode) sizes() (nonceSize, overhead int, err error) {
+	if aead, err := m.New(make([]byte, dataKeySize)); err != nil {
+		return 0, 0, fmt.Errorf("failed to initialise %s cipher: %w", m.Name, err)
+	} else {
+		return aead.NonceSize(), aead.Overhead(), nil
+	}
+}
+
+const (
+	// cipherFormatLegacy objects are sealed in one piece without any additional data. Only used with AES-GCM.
+	cipherFormatLegacy = ""
+	// cipherFormatV2 objects are sealed in one piece with the object key and metadata as additional data.
+	cipherFormatV2 = "v2"
+	// cipherFormatStream objects are sealed in the segmented format with the same additional data as cipherFormatV2.
+	cipherFormatStream = "STREAM"
+)
+
+// cipherMode returns the cipher-mode metadata value for the mode and format.
+func cipherMode(mode AEADMode, format string) string {
+	if format == cipherFormatLegacy {
+		return mode.Name
+	}
+	return mode.Name + "-" + format
+}
+
+// parseCipherMode splits a cipher-mode metadata value into the mode, from the known modes, and the format.
+func parseCipherMode(value string, modes []AEADMode) (mode AEADMode, format string, err error) {
+	name, format := value, cipherFormatLegacy
+	if i := strings.LastIndex(value, "-"); i >= 0 && (value[i+1:] == cipherFormatV2 || value[i+1:] == cipherFormatStream) {
+		name, format = value[:i], value[i+1:]
+	}
+	for _, m := range modes {
+		if m.Name == name && (format != cipherFormatLegacy || m.Name == AEADModeAESGCM.Name) {
+			return m, format, nil
+		}
+	}
+	return AEADMode{}, "", fmt.Errorf("object meta cipher-mode '%s' is not supported", value)
+}
+
+// sealAEAD encrypts the plaintext and returns the random nonce followed by the ciphertext.
+func sealAEAD(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// openAEAD decrypts data produced by sealAEAD in place.
+func openAEAD(aead cipher.AEAD, data, additionalData []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("data size is too small to read nonce")
+	} else if out, err := aead.Open(data[aead.NonceSize():aead.NonceSize()], data[:aead.NonceSize()], data[aead.NonceSize():], additionalData); err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	} else {
+		return out, nil
+	}
+}
@@ -0,0 +1,78 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestClientEncryptedS3_aead_modes(t *testing.T) {
+	for _, mode := range builtinAEADModes {
+		t.Run(mode.Name, func(t *testing.T) {
+			t.Run("v2", func(t *testing.T) {
+				testS3Interface(t, &ClientEncryptedS3{S3: &InMemoryS3{}, BlockCipher: newTestBlockCipher(t), AEADMode: mode})
+			})
+			t.Run("segmented", func(t *testing.T) {
+				testS3Interface(t, &ClientEncryptedS3{S3: &InMemoryS3{}, BlockCipher: newTestBlockCipher(t), AEADMode: mode, SegmentSize: 1024})
+			})
+		})
+	}
+}
+
+func TestClientEncryptedS3_aead_mode_dispatch(t *testing.T) {
+	inner, bc := &InMemoryS3{}, newTestBlockCipher(t)
+	writer := &ClientEncryptedS3{S3: inner, BlockCipher: bc, AEADMode: AEADModeXChaCha20Poly1305}
+	AssertEqual(t, writer.PutObject(context.Background(), "a", map[string]string{"x": "y"}, strings.NewReader("hello")), nil)
+	writer.SegmentSize = 16
+	AssertEqual(t, writer.PutObject(context.Background(), "b", nil, strings.NewReader("hello world, streamed")), nil)
+
+	_, m, err := inner.HeadObject(context.Background(), "a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, m["cipher-mode"], "XCHACHA20-POLY1305-v2")
+	size, _, err := inner.HeadObject(context.Background(), "b")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, size, int64(19+21+16*2))
+
+	// a reader configured with the default mode reads objects sealed with any built-in mode
+	reader := &ClientEncryptedS3{S3: inner, BlockCipher: bc}
+	buff := new(bytes.Buffer)
+	m, err = reader.GetObject(context.Background(), "a", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "hello")
+	AssertEqual(t, m["x"], "y")
+	buff.Reset()
+	_, err = reader.GetObject(context.Background(), "b", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "hello world, streamed")
+	size, _, err = reader.HeadObject(context.Background(), "b")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, size, int64(21))
+}
+
+func TestParseCipherMode(t *testing.T) {
+	for _, tc := range []struct {
+		value, mode, format, err string
+	}{
+		{value: "GCM", mode: "GCM", format: cipherFormatLegacy},
+		{value: "GCM-v2", mode: "GCM", format: cipherFormatV2},
+		{value: "GCM-STREAM", mode: "GCM", format: cipherFormatStream},
+		{value: "CHACHA20-POLY1305-v2", mode: "CHACHA20-POLY1305", format: cipherFormatV2},
+		{value: "XCHACHA20-POLY1305-STREAM", mode: "XCHACHA20-POLY1305", format: cipherFormatStream},
+		{value: "XCHACHA20-POLY1305", err: "object meta cipher-mode 'XCHACHA20-POLY1305' is not supported"},
+		{value: "CBC-v2", err: "object meta cipher-mode 'CBC-v2' is not supported"},
+		{value: "", err: "object meta cipher-mode '' is not supported"},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			mode, format, err := parseCipherMode(tc.value, builtinAEADModes)
+			if tc.err != "" {
+				AssertErrorEqual(t, err, tc.err)
+			} else {
+				AssertEqual(t, err, nil)
+				AssertEqual(t, mode.Name, tc.mode)
+				AssertEqual(t, format, tc.format)
+				AssertEqual(t, cipherMode(mode, format), tc.value)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBlobCorrupt is returned when the content of a blob doesn't match the hash in its key.
+var ErrBlobCorrupt = errors.New("blob content does not match its hash")
+
+// DefaultBlobPrefix is the prefix used by a BlobStore with no Prefix.
+const DefaultBlobPrefix = "blobs/"
+
+// blobRefreshAge is how old the creation time of an existing blob can be before Put rewrites it, so that content that
+// is Put again can't be collected as an old unreferenced blob before it is added to a reference set.
+const blobRefreshAge = time.Minute
+
+// BlobStore stores immutable blobs in the S3 under keys derived from the SHA-256 hash of their content, so identical
+// content is only stored once. Blobs live under Prefix + "sha256/" and named reference sets, which record the blobs
+// that are in use, live under Prefix + "refs/". GC deletes blobs that are not in any reference set.
+type BlobStore struct {
+	S3     S3
+	Prefix string
+	// Clock is used to record when blobs are created. Defaults to time.Now.
+	Clock func() time.Time
+}
+
+func (b *BlobStore) now() time.Time {
+	if b.Clock != nil {
+		return b.Clock()
+	}
+	return time.Now()
+}
+
+func (b *BlobStore) blobPrefix() string {
+	if b.Prefix == "" {
+		return DefaultBlobPrefix + "sha256/"
+	}
+	return b.Prefix + "sha256/"
+}
+
+func (b *BlobStore) refPrefix() string {
+	if b.Prefix == "" {
+		return DefaultBlobPrefix + "refs/"
+	}
+	return b.Prefix + "refs/"
+}
+
+// hashOf returns the hex hash from a blob key.
+func (b *BlobStore) hashOf(key string) (string, error) {
+	hash, ok := strings.CutPrefix(key, b.blobPrefix())
+	if !ok || len(hash) != sha256.Size*2 {
+		return "", fmt.Errorf("'%s' is not a blob key", key)
+	} else if _, err := hex.DecodeString(hash); err != nil {
+		return "", fmt.Errorf("'%s' is not a blob key", key)
+	}
+	return hash, nil
+}
+
+// Put stores the content and returns its blob key. The upload is skipped if the blob already exists and was created
+// recently, otherwise it is rewritten with a fresh creation time to protect it from GC.
+func (b *BlobStore) Put(ctx context.Context, body io.Reader) (key string, err error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to buffer data: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	key = b.blobPrefix() + hex.EncodeToString(sum[:])
+	if _, meta, err := b.S3.HeadObject(ctx, key); err == nil {
+		created, err := strconv.ParseInt(meta["blob-created"], 10, 64)
+		if err == nil && !time.Unix(created, 0).Before(b.now().Add(-blobRefreshAge)) {
+			return key, nil
+		}
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return "", fmt.Errorf("failed to check for existing blob: %w", err)
+	}
+	meta := map[string]string{"blob-created": strconv.FormatInt(b.now().Unix(), 10)}
+	if err := b.S3.PutObject(ctx, key, meta, bytes.NewReader(data)); err != nil {
+		return "", fmt.Errorf("failed to write blob: %w", err)
+	}
+	return key, nil
+}
+
+// Get writes the content of the blob to dst after verifying it against the hash in the key, returning ErrBlobCorrupt
+// if it doesn't match.
+func (b *BlobStore) Get(ctx context.Context, key string, dst io.Writer) error {
+	hash, err := b.hashOf(key)
+	if err != nil {
+		return err
+	}
+	buff := new(bytes.Buffer)
+	if _, err := b.S3.GetObject(ctx, key, buff); err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(buff.Bytes()); hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("%w: %s", ErrBlobCorrupt, key)
+	} else if _, err := dst.Write(buff.Bytes()); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
+
+// SetRefs replaces the named reference set with the given blob keys. Blobs in any reference set are kept by GC.
+func (b *BlobStore) SetRefs(ctx context.Context, name string, keys []string) error {
+	hashes := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if hash, err := b.hashOf(key); err != nil {
+			return err
+		} else {
+			hashes = append(hashes, hash)
+		}
+	}
+	slices.Sort(hashes)
+	hashes = slices.Compact(hashes)
+	if err := b.S3.PutObject(ctx, b.refPrefix()+name, nil, strings.NewReader(strings.Join(hashes, "\n"))); err != nil {
+		return fmt.Errorf("failed to write refs: %w", err)
+	}
+	return nil
+}
+
+// DeleteRefs removes the named reference set.
+func (b *BlobStore) DeleteRefs(ctx context.Context, name string) error {
+	return b.S3.DeleteObject(ctx, b.refPrefix()+name)
+}
+
+// referenced returns the hashes in all reference sets.
+func (b *BlobStore) referenced(ctx context.Context) (map[string]bool, error) {
+	names, _, _, err := b.S3.ListObjects(ctx, b.refPrefix(), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs: %w", err)
+	}
+	out := make(map[string]bool)
+	for _, name := range names {
+		buff := new(bytes.Buffer)
+		if _, err := b.S3.GetObject(ctx, name, buff); errors.Is(err, ErrObjectNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read refs '%s': %w", name, err)
+		}
+		for _, hash := range strings.Split(buff.String(), "\n") {
+			if hash != "" {
+				out[hash] = true
+			}
+		}
+	}
+	return out, nil
+}
+
+// GC deletes the blobs that are not in any reference set and were created at least minAge ago, and returns how many
+// were deleted. The minAge protects blobs that have been Put but not yet added to a reference set, so it must be
+// comfortably longer than a minute plus the time any client takes between the two, since Put only refreshes the
+// creation time of an existing blob once it is a minute old.
+func (b *BlobStore) GC(ctx context.Context, minAge time.Duration) (deleted int, err error) {
+	referenced, err := b.referenced(ctx)
+	if err != nil {
+		return 0, err
+	}
+	keys, _, _, err := b.S3.ListObjects(ctx, b.blobPrefix(), "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list blobs: %w", err)
+	}
+	cutoff := b.now().Add(-minAge)
+	for _, key := range keys {
+		if hash, err := b.hashOf(key); err != nil || referenced[hash] {
+			continue
+		}
+		_, meta, err := b.S3.HeadObject(ctx, key)
+		if errors.Is(err, ErrObjectNotFound) {
+			continue
+		} else if err != nil {
+			return deleted, fmt.Errorf("failed to read blob '%s': %w", key, err)
+		}
+		// blobs without a valid creation time are treated as new so they are never deleted by mistake
+		created, err := strconv.ParseInt(meta["blob-created"], 10, 64)
+		if err != nil || time.Unix(created, 0).After(cutoff) {
+			continue
+		} else if err := b.S3.DeleteObject(ctx, key); err != nil {
+			return deleted, fmt.Errorf("failed to delete blob '%s': %w", key, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
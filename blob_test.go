@@ -0,0 +1,80 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlobStore(t *testing.T) {
+	inner := &InMemoryS3{}
+	recorder := new(MetricsRecorder)
+	b := &BlobStore{S3: &InstrumentedS3{S3: inner, Metrics: recorder}}
+
+	key, err := b.Put(context.Background(), strings.NewReader("hello"))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, key, "blobs/sha256/2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	again, err := b.Put(context.Background(), strings.NewReader("hello"))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, again, key)
+	AssertEqual(t, recorder.Stats(string(OpPutObject)).Count, int64(1))
+
+	buff := new(bytes.Buffer)
+	AssertEqual(t, b.Get(context.Background(), key, buff), nil)
+	AssertEqual(t, buff.String(), "hello")
+
+	AssertEqual(t, inner.PutObject(context.Background(), key, nil, strings.NewReader("tampered")), nil)
+	AssertErrorIs(t, b.Get(context.Background(), key, io.Discard), ErrBlobCorrupt)
+	AssertErrorEqual(t, b.Get(context.Background(), "blobs/sha256/abc", io.Discard), "'blobs/sha256/abc' is not a blob key")
+}
+
+func TestBlobStore_gc(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := &BlobStore{S3: &InMemoryS3{}, Prefix: "cas/", Clock: func() time.Time { return now }}
+	put := func(content string) string {
+		key, err := b.Put(context.Background(), strings.NewReader(content))
+		AssertEqual(t, err, nil)
+		return key
+	}
+	a, c := put("a"), put("c")
+	AssertEqual(t, b.SetRefs(context.Background(), "doc-1", []string{a, a}), nil)
+	now = now.Add(2 * time.Hour)
+	d := put("d")
+
+	deleted, err := b.GC(context.Background(), time.Hour)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, deleted, 1)
+	AssertEqual(t, b.Get(context.Background(), a, io.Discard), nil)
+	AssertErrorIs(t, b.Get(context.Background(), c, io.Discard), ErrObjectNotFound)
+	// too new to be collected
+	AssertEqual(t, b.Get(context.Background(), d, io.Discard), nil)
+
+	AssertEqual(t, b.DeleteRefs(context.Background(), "doc-1"), nil)
+	now = now.Add(2 * time.Hour)
+	deleted, err = b.GC(context.Background(), time.Hour)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, deleted, 2)
+	keys, _, _, err := b.S3.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, keys, []string{})
+}
+
+func TestBlobStore_gc_put_again(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := &BlobStore{S3: &InMemoryS3{}, Clock: func() time.Time { return now }}
+	key, err := b.Put(context.Background(), strings.NewReader("a"))
+	AssertEqual(t, err, nil)
+
+	// the old unreferenced blob is Put again before being added to a reference set
+	now = now.Add(2 * time.Hour)
+	again, err := b.Put(context.Background(), strings.NewReader("a"))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, again, key)
+	deleted, err := b.GC(context.Background(), time.Hour)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, deleted, 0)
+	AssertEqual(t, b.Get(context.Background(), key, io.Discard), nil)
+}
@@ -0,0 +1,278 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// CacheEntry is a cached object along with the ETag it had when it was read.
+type CacheEntry struct {
+	ETag string            `json:"etag"`
+	Meta map[string]string `json:"meta"`
+	Data []byte            `json:"data"`
+}
+
+func (e *CacheEntry) size() int64 {
+	n := int64(len(e.ETag) + len(e.Data))
+	for k, v := range e.Meta {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// CacheStore holds cached objects for CachingS3. Get returns ErrObjectNotFound if the key is not cached. Entries must
+// not be modified after they are passed to Put or returned from Get.
+type CacheStore interface {
+	Get(key string) (*CacheEntry, error)
+	Put(key string, entry *CacheEntry) error
+	Delete(key string) error
+}
+
+// CachingS3 is a read-through cache in front of the underlying S3. Objects under one of the ImmutablePrefixes, or for
+// which Immutable returns true, are never rewritten, so once cached they are served without contacting the
+// underlying S3 at all. Other objects are only cached if the underlying S3 implements ETagGetter, and a cached copy is
+// served only if a HEAD request shows that the ETag hasn't changed. Puts and deletes made through the CachingS3
+// invalidate the cached copy, but changes made by other clients to immutable objects are not noticed.
+//
+// Errors from the Store when reading or filling the cache are treated as misses so that a broken cache only costs
+// performance.
+type CachingS3 struct {
+	S3
+	Store             CacheStore
+	ImmutablePrefixes []string
+	Immutable         func(key string) bool
+}
+
+func (s *CachingS3) isImmutable(key string) bool {
+	for _, prefix := range s.ImmutablePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return s.Immutable != nil && s.Immutable(key)
+}
+
+func writeCacheEntry(entry *CacheEntry, dst io.Writer) (map[string]string, error) {
+	meta := maps.Clone(entry.Meta)
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	if _, err := dst.Write(entry.Data); err != nil {
+		return meta, fmt.Errorf("failed to write: %w", err)
+	}
+	return meta, nil
+}
+
+func (s *CachingS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
+	immutable := s.isImmutable(key)
+	validator, canValidate := s.S3.(ETagGetter)
+	if !immutable && !canValidate {
+		return s.S3.GetObject(ctx, key, dst)
+	}
+
+	if entry, err := s.Store.Get(key); err == nil {
+		if immutable {
+			return writeCacheEntry(entry, dst)
+		} else if _, etag, _, err := validator.HeadObjectETag(ctx, key); errors.Is(err, ErrObjectNotFound) {
+			_ = s.Store.Delete(key)
+			return nil, err
+		} else if err != nil {
+			return nil, err
+		} else if etag != "" && etag == entry.ETag {
+			return writeCacheEntry(entry, dst)
+		}
+	}
+
+	buff := new(bytes.Buffer)
+	var etag string
+	if canValidate {
+		etag, meta, err = validator.GetObjectETag(ctx, key, buff)
+	} else {
+		meta, err = s.S3.GetObject(ctx, key, buff)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if immutable || etag != "" {
+		_ = s.Store.Put(key, &CacheEntry{ETag: etag, Meta: maps.Clone(meta), Data: buff.Bytes()})
+	}
+	if _, err := dst.Write(buff.Bytes()); err != nil {
+		return meta, fmt.Errorf("failed to write: %w", err)
+	}
+	return meta, nil
+}
+
+func (s *CachingS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
+	if s.isImmutable(key) {
+		if entry, err := s.Store.Get(key); err == nil {
+			meta, _ = writeCacheEntry(entry, io.Discard)
+			return int64(len(entry.Data)), meta, nil
+		}
+	}
+	return s.S3.HeadObject(ctx, key)
+}
+
+// ListObjectsAfter uses the start-after support of the underlying S3 if it has any.
+func (s *CachingS3) ListObjectsAfter(ctx context.Context, prefix, delimiter, startAfter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	return listObjectsAfter(ctx, s.S3, prefix, delimiter, startAfter)
+}
+
+// invalidate removes the cached copy of key, reporting a failure to do so only if the operation itself succeeded.
+func (s *CachingS3) invalidate(key string, err error) error {
+	if cacheErr := s.Store.Delete(key); cacheErr != nil && err == nil {
+		return fmt.Errorf("failed to invalidate cached object: %w", cacheErr)
+	}
+	return err
+}
+
+func (s *CachingS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	return s.invalidate(key, s.S3.PutObject(ctx, key, meta, body))
+}
+
+func (s *CachingS3) DeleteObject(ctx context.Context, key string) error {
+	return s.invalidate(key, s.S3.DeleteObject(ctx, key))
+}
+
+var _ S3 = (*CachingS3)(nil)
+var _ StartAfterLister = (*CachingS3)(nil)
+
+// LRUCacheStore is an in-memory CacheStore that evicts the least recently used entries once their total size exceeds
+// the limit.
+type LRUCacheStore struct {
+	maxBytes int64
+
+	mux   sync.Mutex
+	size  int64
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	entry *CacheEntry
+}
+
+func NewLRUCacheStore(maxBytes int64) *LRUCacheStore {
+	return &LRUCacheStore{maxBytes: maxBytes, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *LRUCacheStore) Get(key string) (*CacheEntry, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if el, ok := l.items[key]; !ok {
+		return nil, ErrObjectNotFound
+	} else {
+		l.order.MoveToFront(el)
+		return el.Value.(*lruItem).entry, nil
+	}
+}
+
+func (l *LRUCacheStore) Put(key string, entry *CacheEntry) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.remove(key)
+	if entry.size() > l.maxBytes {
+		return nil
+	}
+	l.items[key] = l.order.PushFront(&lruItem{key: key, entry: entry})
+	l.size += entry.size()
+	for l.size > l.maxBytes {
+		l.remove(l.order.Back().Value.(*lruItem).key)
+	}
+	return nil
+}
+
+func (l *LRUCacheStore) Delete(key string) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.remove(key)
+	return nil
+}
+
+func (l *LRUCacheStore) remove(key string) {
+	if el, ok := l.items[key]; ok {
+		l.order.Remove(el)
+		delete(l.items, key)
+		l.size -= el.Value.(*lruItem).entry.size()
+	}
+}
+
+var _ CacheStore = (*LRUCacheStore)(nil)
+
+// DirCacheStore is a CacheStore that keeps each entry in a file in Dir, so the cache survives restarts. The directory
+// must exist and should not be used for anything else. Entries are never evicted.
+type DirCacheStore struct {
+	Dir string
+}
+
+func (d *DirCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.Dir, hex.EncodeToString(sum[:]))
+}
+
+type dirCacheFile struct {
+	Key string `json:"key"`
+	CacheEntry
+}
+
+func (d *DirCacheStore) Get(key string) (*CacheEntry, error) {
+	raw, err := os.ReadFile(d.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read cache file: %w", err)
+	}
+	file := new(dirCacheFile)
+	if err := json.Unmarshal(raw, file); err != nil {
+		return nil, fmt.Errorf("failed to decode cache file: %w", err)
+	} else if file.Key != key {
+		return nil, ErrObjectNotFound
+	}
+	return &file.CacheEntry, nil
+}
+
+// Put writes the entry to a temporary file first and renames it into place so that readers never see partial entries.
+func (d *DirCacheStore) Put(key string, entry *CacheEntry) error {
+	raw, err := json.Marshal(&dirCacheFile{Key: key, CacheEntry: *entry})
+	if err != nil {
+		return fmt.Errorf("failed to encode cache file: %w", err)
+	}
+	f, err := os.CreateTemp(d.Dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.Write(raw); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write cache file: %w", err)
+	} else if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
+	} else if err := os.Rename(f.Name(), d.path(key)); err != nil {
+		return fmt.Errorf("failed to rename cache file: %w", err)
+	}
+	return nil
+}
+
+func (d *DirCacheStore) Delete(key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove cache file: %w", err)
+	}
+	return nil
+}
+
+var _ CacheStore = (*DirCacheStore)(nil)
@@ -0,0 +1,131 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// countingS3 counts the reads and lists made against an InMemoryS3.
+type countingS3 struct {
+	*InMemoryS3
+	counts map[S3Operation]int
+}
+
+func newCountingS3() *countingS3 {
+	return &countingS3{InMemoryS3: &InMemoryS3{}, counts: make(map[S3Operation]int)}
+}
+
+func (c *countingS3) GetObject(ctx context.Context, key string, dst io.Writer) (map[string]string, error) {
+	c.counts[OpGetObject]++
+	return c.InMemoryS3.GetObject(ctx, key, dst)
+}
+
+func (c *countingS3) GetObjectETag(ctx context.Context, key string, dst io.Writer) (string, map[string]string, error) {
+	c.counts[OpGetObject]++
+	return c.InMemoryS3.GetObjectETag(ctx, key, dst)
+}
+
+func (c *countingS3) HeadObject(ctx context.Context, key string) (int64, map[string]string, error) {
+	c.counts[OpHeadObject]++
+	return c.InMemoryS3.HeadObject(ctx, key)
+}
+
+func (c *countingS3) HeadObjectETag(ctx context.Context, key string) (int64, string, map[string]string, error) {
+	c.counts[OpHeadObject]++
+	return c.InMemoryS3.HeadObjectETag(ctx, key)
+}
+
+func (c *countingS3) ListObjects(ctx context.Context, prefix, delimiter string) ([]string, []int64, []string, error) {
+	c.counts[OpListObjects]++
+	return c.InMemoryS3.ListObjects(ctx, prefix, delimiter)
+}
+
+func (c *countingS3) ListObjectsAfter(ctx context.Context, prefix, delimiter, startAfter string) ([]string, []int64, []string, error) {
+	c.counts[OpListObjects]++
+	return c.InMemoryS3.ListObjectsAfter(ctx, prefix, delimiter, startAfter)
+}
+
+func TestCachingS3(t *testing.T) {
+	t.Run("lru", func(t *testing.T) {
+		testS3Interface(t, &CachingS3{S3: &InMemoryS3{}, Store: NewLRUCacheStore(1 << 20), ImmutablePrefixes: []string{"photos/"}})
+	})
+	t.Run("dir", func(t *testing.T) {
+		testS3Interface(t, &CachingS3{S3: &InMemoryS3{}, Store: &DirCacheStore{Dir: t.TempDir()}, ImmutablePrefixes: []string{"photos/"}})
+	})
+}
+
+func TestCachingS3_immutable(t *testing.T) {
+	inner := newCountingS3()
+	s := &CachingS3{S3: inner, Store: NewLRUCacheStore(1 << 20), ImmutablePrefixes: []string{"changes/"}}
+	AssertEqual(t, s.PutObject(context.Background(), "changes/1", map[string]string{"x": "y"}, strings.NewReader("one")), nil)
+
+	for range 3 {
+		buff := new(bytes.Buffer)
+		m, err := s.GetObject(context.Background(), "changes/1", buff)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, buff.String(), "one")
+		AssertEqual(t, m["x"], "y")
+		n, _, err := s.HeadObject(context.Background(), "changes/1")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, n, int64(3))
+	}
+	AssertEqual(t, inner.counts, map[S3Operation]int{OpGetObject: 1})
+
+	// our own writes invalidate the cached copy
+	AssertEqual(t, s.PutObject(context.Background(), "changes/1", nil, strings.NewReader("uno")), nil)
+	buff := new(bytes.Buffer)
+	_, err := s.GetObject(context.Background(), "changes/1", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "uno")
+	AssertEqual(t, s.DeleteObject(context.Background(), "changes/1"), nil)
+	_, err = s.GetObject(context.Background(), "changes/1", io.Discard)
+	AssertErrorIs(t, err, ErrObjectNotFound)
+}
+
+func TestCachingS3_mutable(t *testing.T) {
+	inner := newCountingS3()
+	s := &CachingS3{S3: inner, Store: &DirCacheStore{Dir: t.TempDir()}}
+	AssertEqual(t, inner.PutObject(context.Background(), "snapshot", nil, strings.NewReader("one")), nil)
+
+	read := func() string {
+		buff := new(bytes.Buffer)
+		_, err := s.GetObject(context.Background(), "snapshot", buff)
+		AssertEqual(t, err, nil)
+		return buff.String()
+	}
+	AssertEqual(t, read(), "one")
+	AssertEqual(t, read(), "one")
+	AssertEqual(t, inner.counts, map[S3Operation]int{OpGetObject: 1, OpHeadObject: 1})
+
+	// a write by another client changes the etag
+	AssertEqual(t, inner.PutObject(context.Background(), "snapshot", nil, strings.NewReader("two")), nil)
+	AssertEqual(t, read(), "two")
+	AssertEqual(t, inner.counts, map[S3Operation]int{OpGetObject: 2, OpHeadObject: 2})
+
+	AssertEqual(t, inner.DeleteObject(context.Background(), "snapshot"), nil)
+	_, err := s.GetObject(context.Background(), "snapshot", io.Discard)
+	AssertErrorIs(t, err, ErrObjectNotFound)
+}
+
+func TestLRUCacheStore(t *testing.T) {
+	l := NewLRUCacheStore(10)
+	for i := range 4 {
+		AssertEqual(t, l.Put(fmt.Sprint(i), &CacheEntry{Data: []byte("abc")}), nil)
+		if i == 2 {
+			_, err := l.Get("0")
+			AssertEqual(t, err, nil)
+		}
+	}
+	for key, cached := range map[string]bool{"0": true, "1": false, "2": true, "3": true} {
+		_, err := l.Get(key)
+		AssertEqual(t, err == nil, cached)
+	}
+
+	AssertEqual(t, l.Put("big", &CacheEntry{Data: make([]byte, 11)}), nil)
+	_, err := l.Get("big")
+	AssertErrorIs(t, err, ErrObjectNotFound)
+}
@@ -0,0 +1,196 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The change log of a document is stored as one object per change at docs/<document>/changes/<peer>/<seq>. Each peer
+// only appends under its own prefix with sequence numbers that start at 1 and increase by one, zero-padded so that
+// the lexical order of the keys is the sequence order. A reader that remembers the last sequence it has seen from each
+// peer can list only the changes after it.
+
+var (
+	// ErrChangeExists is returned when appending a change with a sequence number that is already taken.
+	ErrChangeExists = errors.New("change already exists")
+	// ErrChangeGap is returned when the sequence numbers of a peer's changes are not consecutive.
+	ErrChangeGap = errors.New("gap in change sequence")
+	// ErrDuplicateChange is returned when a peer has more than one change with the same sequence number.
+	ErrDuplicateChange = errors.New("duplicate change sequence")
+)
+
+// changeSeqDigits fits any uint64.
+const changeSeqDigits = 20
+
+// validateKeySegment rejects ids that can't be used as a single segment of an object key.
+func validateKeySegment(kind, id string) error {
+	if id == "" || id == "." || id == ".." || strings.Contains(id, "/") {
+		return fmt.Errorf("%w: %s id '%s'", ErrInvalidKey, kind, id)
+	}
+	return nil
+}
+
+// documentsPrefix is the prefix of all the documents.
+const documentsPrefix = "docs/"
+
+// DocumentPrefix returns the prefix of all the objects of a document.
+func DocumentPrefix(documentId string) string {
+	return documentsPrefix + documentId + "/"
+}
+
+// ChangesPrefix returns the prefix of the change logs of a document.
+func ChangesPrefix(documentId string) string {
+	return DocumentPrefix(documentId) + "changes/"
+}
+
+// ChangeKey returns the key of the change with the given sequence number from peer.
+func ChangeKey(documentId, peer string, seq uint64) string {
+	return fmt.Sprintf("%s%s/%0*d", ChangesPrefix(documentId), peer, changeSeqDigits, seq)
+}
+
+// ParseChangeKey returns the document, peer and sequence number of a change key.
+func ParseChangeKey(key string) (documentId, peer string, seq uint64, err error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 5 || parts[0] != "docs" || parts[2] != "changes" || parts[1] == "" || parts[3] == "" {
+		return "", "", 0, fmt.Errorf("'%s' is not a change key", key)
+	} else if seq, err = strconv.ParseUint(parts[4], 10, 64); err != nil {
+		return "", "", 0, fmt.Errorf("'%s' is not a change key: invalid sequence", key)
+	}
+	return parts[1], parts[3], seq, nil
+}
+
+// PeerChangeKeys returns a function that reports whether a key, or list prefix, is in the change log of the peer in
+// any document. It is suitable for the Owned field of an OutboxS3 that only this peer writes through.
+func PeerChangeKeys(peer string) func(key string) bool {
+	return func(key string) bool {
+		parts := strings.Split(key, "/")
+		return len(parts) >= 5 && parts[0] == "docs" && parts[1] != "" && parts[2] == "changes" && parts[3] == peer
+	}
+}
+
+// ChangeRef identifies a change object found in a change log.
+type ChangeRef struct {
+	Peer string
+	Seq  uint64
+	Key  string
+	Size int64
+}
+
+// ChangeLog reads and appends the changes of one document.
+type ChangeLog struct {
+	S3         S3
+	DocumentId string
+}
+
+// Append writes the change with the given sequence number for the peer, returning ErrChangeExists if the sequence
+// number is already taken. When the S3 implements ConditionalPutter the change is written with a create-if-not-exists
+// write, otherwise the check is not atomic and each peer must only be written by one process at a time.
+func (c *ChangeLog) Append(ctx context.Context, peer string, seq uint64, meta map[string]string, body io.Reader) error {
+	if err := validateKeySegment("document", c.DocumentId); err != nil {
+		return err
+	} else if err := validateKeySegment("peer", peer); err != nil {
+		return err
+	} else if seq == 0 {
+		return errors.New("change sequence numbers start at 1")
+	}
+	key := ChangeKey(c.DocumentId, peer, seq)
+	if putter, ok := c.S3.(ConditionalPutter); ok {
+		if _, err := putter.PutObjectIf(ctx, key, meta, body, PutCondition{IfNoneMatch: true}); errors.Is(err, ErrPreconditionFailed) {
+			return fmt.Errorf("%w: %s", ErrChangeExists, key)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+	if _, _, err := c.S3.HeadObject(ctx, key); err == nil {
+		return fmt.Errorf("%w: %s", ErrChangeExists, key)
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("failed to check for existing change: %w", err)
+	}
+	return c.S3.PutObject(ctx, key, meta, body)
+}
+
+// Peers returns the peers that have written changes to the document.
+func (c *ChangeLog) Peers(ctx context.Context) ([]string, error) {
+	if err := validateKeySegment("document", c.DocumentId); err != nil {
+		return nil, err
+	}
+	_, _, prefixes, err := c.S3.ListObjects(ctx, ChangesPrefix(c.DocumentId), "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peers: %w", err)
+	}
+	peers := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		peers = append(peers, strings.TrimSuffix(strings.TrimPrefix(p, ChangesPrefix(c.DocumentId)), "/"))
+	}
+	return peers, nil
+}
+
+// PeerChanges returns the changes from the peer with sequence numbers after the given one, which is 0 for all
+// changes. If the sequence numbers are not consecutive, the changes before the gap or duplicate are returned along
+// with an error wrapping ErrChangeGap or ErrDuplicateChange, since later changes may still be in flight.
+func (c *ChangeLog) PeerChanges(ctx context.Context, peer string, after uint64) ([]ChangeRef, error) {
+	if err := validateKeySegment("document", c.DocumentId); err != nil {
+		return nil, err
+	} else if err := validateKeySegment("peer", peer); err != nil {
+		return nil, err
+	}
+	startAfter := ""
+	if after > 0 {
+		startAfter = ChangeKey(c.DocumentId, peer, after)
+	}
+	keys, sizes, _, err := listObjectsAfter(ctx, c.S3, ChangesPrefix(c.DocumentId)+peer+"/", "", startAfter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changes: %w", err)
+	}
+	refs := make([]ChangeRef, 0, len(keys))
+	expected := after + 1
+	for i, key := range keys {
+		_, _, seq, err := ParseChangeKey(key)
+		if err != nil {
+			return refs, err
+		} else if seq < expected {
+			return refs, fmt.Errorf("%w: %s", ErrDuplicateChange, key)
+		} else if seq > expected {
+			return refs, fmt.Errorf("%w: expected sequence %d from peer '%s' but found %s", ErrChangeGap, expected, peer, key)
+		}
+		refs = append(refs, ChangeRef{Peer: peer, Seq: seq, Key: key, Size: sizes[i]})
+		expected++
+	}
+	return refs, nil
+}
+
+// Changes returns the changes from every peer after the sequence numbers in seen, which maps peers to the last
+// sequence number read from them. Like PeerChanges, the changes before any gap are returned along with the error.
+func (c *ChangeLog) Changes(ctx context.Context, seen map[string]uint64) ([]ChangeRef, error) {
+	peers, err := c.Peers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var refs []ChangeRef
+	var errs []error
+	for _, peer := range peers {
+		peerRefs, err := c.PeerChanges(ctx, peer, seen[peer])
+		refs = append(refs, peerRefs...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return refs, errors.Join(errs...)
+}
+
+// HighWaterMarks returns the last sequence number per peer after reading the refs on top of seen.
+func HighWaterMarks(seen map[string]uint64, refs []ChangeRef) map[string]uint64 {
+	out := make(map[string]uint64, len(seen))
+	for peer, seq := range seen {
+		out[peer] = seq
+	}
+	for _, ref := range refs {
+		out[ref.Peer] = max(out[ref.Peer], ref.Seq)
+	}
+	return out
+}
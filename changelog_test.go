@@ -0,0 +1,91 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestChangeKey(t *testing.T) {
+	key := ChangeKey("doc-1", "peer-a", 42)
+	AssertEqual(t, key, "docs/doc-1/changes/peer-a/00000000000000000042")
+	documentId, peer, seq, err := ParseChangeKey(key)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, documentId, "doc-1")
+	AssertEqual(t, peer, "peer-a")
+	AssertEqual(t, seq, uint64(42))
+
+	_, _, _, err = ParseChangeKey("docs/doc-1/snapshots/peer-a/1")
+	AssertErrorEqual(t, err, "'docs/doc-1/snapshots/peer-a/1' is not a change key")
+	_, _, _, err = ParseChangeKey("docs/doc-1/changes/peer-a/x")
+	AssertErrorEqual(t, err, "'docs/doc-1/changes/peer-a/x' is not a change key: invalid sequence")
+}
+
+func TestChangeLog(t *testing.T) {
+	inner := &InMemoryS3{}
+	c := &ChangeLog{S3: inner, DocumentId: "doc-1"}
+	for _, peer := range []string{"peer-a", "peer-b"} {
+		for seq := uint64(1); seq <= 11; seq++ {
+			AssertEqual(t, c.Append(context.Background(), peer, seq, nil, strings.NewReader(fmt.Sprint(seq))), nil)
+		}
+	}
+	AssertErrorIs(t, c.Append(context.Background(), "peer-a", 3, nil, strings.NewReader("x")), ErrChangeExists)
+	AssertErrorIs(t, c.Append(context.Background(), "peer/a", 1, nil, strings.NewReader("x")), ErrInvalidKey)
+
+	peers, err := c.Peers(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, peers, []string{"peer-a", "peer-b"})
+
+	refs, err := c.PeerChanges(context.Background(), "peer-a", 9)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, refs, []ChangeRef{
+		{Peer: "peer-a", Seq: 10, Key: ChangeKey("doc-1", "peer-a", 10), Size: 2},
+		{Peer: "peer-a", Seq: 11, Key: ChangeKey("doc-1", "peer-a", 11), Size: 2},
+	})
+
+	seen := map[string]uint64{"peer-a": 11, "peer-b": 5}
+	refs, err = c.Changes(context.Background(), seen)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(refs), 6)
+	AssertEqual(t, HighWaterMarks(seen, refs), map[string]uint64{"peer-a": 11, "peer-b": 11})
+
+	// the fallback for stores without start-after gives the same result
+	fallback := &ChangeLog{S3: &PolicyS3{S3: inner}, DocumentId: "doc-1"}
+	fallbackRefs, err := fallback.Changes(context.Background(), seen)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, fallbackRefs, refs)
+}
+
+func TestChangeLog_validation(t *testing.T) {
+	inner := &InMemoryS3{}
+	c := &ChangeLog{S3: inner, DocumentId: "doc-1"}
+	for _, seq := range []uint64{1, 2, 4} {
+		AssertEqual(t, c.Append(context.Background(), "peer-a", seq, nil, strings.NewReader("x")), nil)
+	}
+	refs, err := c.PeerChanges(context.Background(), "peer-a", 0)
+	AssertErrorIs(t, err, ErrChangeGap)
+	AssertEqual(t, len(refs), 2)
+
+	AssertEqual(t, c.Append(context.Background(), "peer-a", 3, nil, strings.NewReader("x")), nil)
+	AssertEqual(t, inner.PutObject(context.Background(), "docs/doc-1/changes/peer-a/4", nil, strings.NewReader("x")), nil)
+	refs, err = c.PeerChanges(context.Background(), "peer-a", 2)
+	AssertErrorIs(t, err, ErrDuplicateChange)
+	AssertEqual(t, len(refs), 2)
+}
+
+func TestChangeLog_Append_conditional(t *testing.T) {
+	inner := &InMemoryS3{}
+	c := &ChangeLog{S3: &staleHeadS3{InMemoryS3: inner}, DocumentId: "doc-1"}
+	AssertEqual(t, c.Append(context.Background(), "peer-a", 1, nil, strings.NewReader("one")), nil)
+	AssertErrorIs(t, c.Append(context.Background(), "peer-a", 1, nil, strings.NewReader("two")), ErrChangeExists)
+	buff := new(strings.Builder)
+	_, err := inner.GetObject(context.Background(), ChangeKey("doc-1", "peer-a", 1), buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "one")
+
+	// stores without conditional writes fall back to checking first
+	fallback := &ChangeLog{S3: &PolicyS3{S3: inner}, DocumentId: "doc-1"}
+	AssertErrorIs(t, fallback.Append(context.Background(), "peer-a", 1, nil, strings.NewReader("two")), ErrChangeExists)
+	AssertEqual(t, fallback.Append(context.Background(), "peer-a", 2, nil, strings.NewReader("two")), nil)
+}
@@ -0,0 +1,133 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// DefaultCompressionMinSize is the body size below which CompressedS3 stores objects uncompressed by default, since
+// the gzip header and footer would outweigh any savings.
+const DefaultCompressionMinSize = 256
+
+// DefaultMaxDecompressedSize is the largest object CompressedS3 decompresses by default.
+const DefaultMaxDecompressedSize = 1 << 30
+
+const contentEncodingGzip = "gzip"
+
+// CompressedS3 gzip compresses objects before they are written to the underlying S3 and decompresses them when read.
+// Compressed objects are marked with a content-encoding metadata entry and record their uncompressed size, objects
+// without it (including those written before compression was enabled) are passed through as is. Bodies that are
+// smaller than MinSize or that don't shrink are stored uncompressed. ListObjects returns the stored sizes since the
+// uncompressed sizes are only available from the metadata of each object.
+//
+// When combined with ClientEncryptedS3, the CompressedS3 must wrap the ClientEncryptedS3 so that the plaintext is
+// compressed before it is encrypted. The reverse order still works but ciphertext won't compress.
+type CompressedS3 struct {
+	S3
+	// Level is the gzip compression level, gzip.DefaultCompression when zero.
+	Level int
+	// MinSize is the smallest body that is compressed, DefaultCompressionMinSize when zero.
+	MinSize int
+	// MaxDecompressedSize is the largest object that GetObject decompresses, DefaultMaxDecompressedSize when zero.
+	// Larger objects fail to read, after the first MaxDecompressedSize bytes have been written to dst, so that a small
+	// compressed object can't expand without bound.
+	MaxDecompressedSize int64
+}
+
+func (s *CompressedS3) maxDecompressedSize() int64 {
+	if s.MaxDecompressedSize > 0 {
+		return s.MaxDecompressedSize
+	}
+	return DefaultMaxDecompressedSize
+}
+
+func (s *CompressedS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
+	buff := new(bytes.Buffer)
+	if meta, err = s.S3.GetObject(ctx, key, buff); err != nil {
+		return nil, err
+	}
+	switch encoding := meta["content-encoding"]; encoding {
+	case "":
+		if _, err := dst.Write(buff.Bytes()); err != nil {
+			return nil, fmt.Errorf("failed to write: %w", err)
+		}
+	case contentEncodingGzip:
+		limit := s.maxDecompressedSize()
+		if size, err := strconv.ParseInt(meta["content-uncompressed-size"], 10, 64); err == nil && size > limit {
+			return nil, fmt.Errorf("object size %d exceeds the max decompressed size %d", size, limit)
+		}
+		if zr, err := gzip.NewReader(buff); err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		} else if n, err := io.Copy(dst, io.LimitReader(zr, limit)); err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		} else if _, err := io.ReadFull(zr, make([]byte, 1)); n == limit && err == nil {
+			return nil, fmt.Errorf("object exceeds the max decompressed size %d", limit)
+		} else if err := zr.Close(); err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("object meta content-encoding '%s' is not supported", encoding)
+	}
+	return meta, nil
+}
+
+// HeadObject returns the uncompressed size of the object.
+func (s *CompressedS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
+	if size, meta, err = s.S3.HeadObject(ctx, key); err != nil {
+		return 0, nil, err
+	} else if meta["content-encoding"] == "" {
+		return size, meta, nil
+	} else if size, err = strconv.ParseInt(meta["content-uncompressed-size"], 10, 64); err != nil {
+		return 0, nil, fmt.Errorf("object meta content-uncompressed-size is invalid: %w", err)
+	}
+	return size, meta, nil
+}
+
+func (s *CompressedS3) compress(data []byte) ([]byte, error) {
+	level := s.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	buff := new(bytes.Buffer)
+	if zw, err := gzip.NewWriterLevel(buff, level); err != nil {
+		return nil, fmt.Errorf("failed to initialise gzip writer: %w", err)
+	} else if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	} else if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+	return buff.Bytes(), nil
+}
+
+func (s *CompressedS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to buffer data: %w", err)
+	}
+
+	// encoding entries left over from a previous read are replaced
+	meta = lowerKeys(meta)
+	delete(meta, "content-encoding")
+	delete(meta, "content-uncompressed-size")
+
+	minSize := s.MinSize
+	if minSize == 0 {
+		minSize = DefaultCompressionMinSize
+	}
+	if len(data) >= minSize {
+		if compressed, err := s.compress(data); err != nil {
+			return err
+		} else if len(compressed) < len(data) {
+			meta["content-encoding"] = contentEncodingGzip
+			meta["content-uncompressed-size"] = strconv.Itoa(len(data))
+			data = compressed
+		}
+	}
+	return s.S3.PutObject(ctx, key, meta, bytes.NewReader(data))
+}
+
+var _ S3 = (*CompressedS3)(nil)
@@ -0,0 +1,133 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressedS3(t *testing.T) {
+	testS3Interface(t, &CompressedS3{S3: &InMemoryS3{}})
+}
+
+func TestCompressedS3_round_trip(t *testing.T) {
+	inner := &InMemoryS3{}
+	s := &CompressedS3{S3: inner}
+	plain := strings.Repeat("automerge change data ", 100)
+	AssertEqual(t, s.PutObject(context.Background(), "a", map[string]string{"Content-Encoding": "br", "x": "y"}, strings.NewReader(plain)), nil)
+
+	n, m, err := inner.HeadObject(context.Background(), "a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, m["content-encoding"], "gzip")
+	AssertEqual(t, m["content-uncompressed-size"], "2200")
+	AssertEqual(t, n < 200, true)
+
+	n, m, err = s.HeadObject(context.Background(), "a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, int64(len(plain)))
+	AssertEqual(t, m["x"], "y")
+
+	buff := new(bytes.Buffer)
+	m, err = s.GetObject(context.Background(), "a", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), plain)
+	AssertEqual(t, m["x"], "y")
+}
+
+func TestCompressedS3_uncompressed(t *testing.T) {
+	inner := &InMemoryS3{}
+	s := &CompressedS3{S3: inner, MinSize: 16}
+
+	t.Run("small", func(t *testing.T) {
+		AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("short")), nil)
+		_, m, err := inner.HeadObject(context.Background(), "a")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, m["content-encoding"], "")
+	})
+
+	t.Run("incompressible", func(t *testing.T) {
+		AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("0123456789abcdefghij")), nil)
+		_, m, err := inner.HeadObject(context.Background(), "a")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, m["content-encoding"], "")
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		AssertEqual(t, inner.PutObject(context.Background(), "b", map[string]string{"x": "y"}, strings.NewReader(strings.Repeat("a", 100))), nil)
+		buff := new(bytes.Buffer)
+		m, err := s.GetObject(context.Background(), "b", buff)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, buff.String(), strings.Repeat("a", 100))
+		AssertEqual(t, m["x"], "y")
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		AssertEqual(t, inner.PutObject(context.Background(), "c", map[string]string{"content-encoding": "br"}, strings.NewReader("a")), nil)
+		_, err := s.GetObject(context.Background(), "c", new(bytes.Buffer))
+		AssertErrorEqual(t, err, "object meta content-encoding 'br' is not supported")
+	})
+}
+
+func TestCompressedS3_with_encryption(t *testing.T) {
+	bc := newTestBlockCipher(t)
+	plain := strings.Repeat("automerge change data ", 100)
+
+	t.Run("compress then encrypt", func(t *testing.T) {
+		inner := &InMemoryS3{}
+		s := &CompressedS3{S3: &ClientEncryptedS3{S3: inner, BlockCipher: bc, EncryptMetadata: true}}
+		testS3Interface(t, s)
+		AssertEqual(t, s.PutObject(context.Background(), "a", map[string]string{"x": "y"}, strings.NewReader(plain)), nil)
+
+		n, m, err := inner.HeadObject(context.Background(), "a")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, n < 200, true)
+		AssertEqual(t, m["content-encoding"], "")
+
+		n, m, err = s.HeadObject(context.Background(), "a")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, n, int64(len(plain)))
+		AssertEqual(t, m["content-encoding"], "gzip")
+
+		buff := new(bytes.Buffer)
+		m, err = s.GetObject(context.Background(), "a", buff)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, buff.String(), plain)
+		AssertEqual(t, m["x"], "y")
+	})
+
+	t.Run("encrypt then compress", func(t *testing.T) {
+		s := &ClientEncryptedS3{S3: &CompressedS3{S3: &InMemoryS3{}}, BlockCipher: bc}
+		testS3Interface(t, s)
+		AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader(plain)), nil)
+		buff := new(bytes.Buffer)
+		_, err := s.GetObject(context.Background(), "a", buff)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, buff.String(), plain)
+	})
+}
+
+func TestCompressedS3_max_decompressed_size(t *testing.T) {
+	inner := &InMemoryS3{}
+	s := &CompressedS3{S3: inner, MaxDecompressedSize: 1000}
+	AssertEqual(t, s.PutObject(context.Background(), "a", nil, bytes.NewReader(make([]byte, 1000))), nil)
+	AssertEqual(t, s.PutObject(context.Background(), "b", nil, bytes.NewReader(make([]byte, 1<<20))), nil)
+
+	buff := new(bytes.Buffer)
+	_, err := s.GetObject(context.Background(), "a", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.Len(), 1000)
+
+	_, err = s.GetObject(context.Background(), "b", io.Discard)
+	AssertErrorEqual(t, err, "object size 1048576 exceeds the max decompressed size 1000")
+
+	// the recorded size can't be trusted, so the limit is also enforced while decompressing
+	raw := new(bytes.Buffer)
+	m, err := inner.GetObject(context.Background(), "b", raw)
+	AssertEqual(t, err, nil)
+	m["content-uncompressed-size"] = "10"
+	AssertEqual(t, inner.PutObject(context.Background(), "b", m, raw), nil)
+	_, err = s.GetObject(context.Background(), "b", io.Discard)
+	AssertErrorEqual(t, err, "object exceeds the max decompressed size 1000")
+}
@@ -0,0 +1,655 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KeyEncryptionKey wraps and unwraps the per-object data keys used by ClientEncryptedS3. Implementations may hold the
+// key locally or delegate to a remote key management service.
+type KeyEncryptionKey interface {
+	WrapKey(ctx context.Context, dataKey []byte) (wrappedKey []byte, err error)
+	UnwrapKey(ctx context.Context, wrappedKey []byte) (dataKey []byte, err error)
+}
+
+// BlockCipherKEK is a KeyEncryptionKey that wraps data keys with AES-GCM under a local block cipher.
+type BlockCipherKEK struct {
+	BlockCipher cipher.Block
+}
+
+func (b *BlockCipherKEK) WrapKey(ctx context.Context, dataKey []byte) (wrappedKey []byte, err error) {
+	return sealGCM(b.BlockCipher, dataKey, nil)
+}
+
+func (b *BlockCipherKEK) UnwrapKey(ctx context.Context, wrappedKey []byte) (dataKey []byte, err error) {
+	return openGCM(b.BlockCipher, wrappedKey, nil)
+}
+
+var _ KeyEncryptionKey = (*BlockCipherKEK)(nil)
+
+// sealGCM encrypts the plaintext with AES-GCM and returns the random nonce followed by the ciphertext.
+func sealGCM(block cipher.Block, plaintext, additionalData []byte) ([]byte, error) {
+	if gcm, err := cipher.NewGCM(block); err != nil {
+		return nil, fmt.Errorf("failed to initialise gcm cipher: %w", err)
+	} else {
+		return sealAEAD(gcm, plaintext, additionalData)
+	}
+}
+
+// openGCM decrypts data produced by sealGCM in place.
+func openGCM(block cipher.Block, data, additionalData []byte) ([]byte, error) {
+	if gcm, err := cipher.NewGCM(block); err != nil {
+		return nil, fmt.Errorf("failed to initialise gcm cipher: %w", err)
+	} else {
+		return openAEAD(gcm, data, additionalData)
+	}
+}
+
+// Keyring holds a set of key encryption keys by id. New objects are encrypted under the CurrentKeyId while every key in
+// Keys, including retired ones, can be used to decrypt existing objects.
+type Keyring struct {
+	CurrentKeyId string
+	Keys         map[string]KeyEncryptionKey
+}
+
+func (k *Keyring) Current() (id string, kek KeyEncryptionKey, err error) {
+	if kek, err = k.Get(k.CurrentKeyId); err != nil {
+		return "", nil, fmt.Errorf("current key: %w", err)
+	}
+	return k.CurrentKeyId, kek, nil
+}
+
+func (k *Keyring) Get(id string) (KeyEncryptionKey, error) {
+	if kek, ok := k.Keys[id]; !ok || kek == nil {
+		return nil, fmt.Errorf("key '%s' not found in keyring", id)
+	} else {
+		return kek, nil
+	}
+}
+
+// lowerKeys returns a copy of the metadata with lower-cased keys, matching what S3 returns on read.
+func lowerKeys(meta map[string]string) map[string]string {
+	out := make(map[string]string, len(meta))
+	for k, v := range meta {
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
+
+// buildAuthenticatedData encodes the object key and the named metadata entries as length-prefixed fields.
+func buildAuthenticatedData(key string, meta map[string]string, names []string) []byte {
+	out := []byte("automerge-s3-sync/aad/v2")
+	out = binary.AppendUvarint(out, uint64(len(key)))
+	out = append(out, key...)
+	for _, name := range names {
+		out = binary.AppendUvarint(out, uint64(len(name)))
+		out = append(out, name...)
+		out = binary.AppendUvarint(out, uint64(len(meta[name])))
+		out = append(out, meta[name]...)
+	}
+	return out
+}
+
+// sealAuthenticatedData records the names of all metadata entries in the cipher-aad entry and returns the additional
+// data binding them and the object key to the ciphertext.
+func sealAuthenticatedData(key string, meta map[string]string) []byte {
+	delete(meta, "cipher-aad")
+	names := slices.Sorted(maps.Keys(meta))
+	meta["cipher-aad"] = strings.Join(names, ",")
+	return buildAuthenticatedData(key, meta, names)
+}
+
+// authenticatedData rebuilds the additional data for an object read from storage. It returns the subset of the
+// metadata that is covered by it, so that entries added by anyone else are not passed on to the caller.
+func authenticatedData(key string, meta map[string]string) ([]byte, map[string]string, error) {
+	encodedNames, ok := meta["cipher-aad"]
+	if !ok {
+		return nil, nil, fmt.Errorf("object meta is missing cipher-aad")
+	}
+	var names []string
+	if encodedNames != "" {
+		names = strings.Split(encodedNames, ",")
+	}
+	out := make(map[string]string, len(names))
+	for _, name := range names {
+		if v, ok := meta[name]; !ok {
+			return nil, nil, fmt.Errorf("authenticated meta '%s' is missing", name)
+		} else {
+			out[name] = v
+		}
+	}
+	return buildAuthenticatedData(key, meta, names), out, nil
+}
+
+// dataKeySize is the size of the key generated for each object.
+const dataKeySize = 32
+
+// ClientEncryptedS3 encrypts objects before they are written to the underlying S3 and decrypts them when read. Each
+// object is encrypted with a freshly generated data key which is wrapped by a key encryption key and stored in the
+// object metadata. The wrapping key is the current key of the Keyring when set, otherwise the KeyEncryptionKey, otherwise
+// the BlockCipher. Objects written by older versions, which were encrypted directly with the BlockCipher, remain
+// readable.
+type ClientEncryptedS3 struct {
+	S3
+	BlockCipher      cipher.Block
+	KeyEncryptionKey KeyEncryptionKey
+	Keyring          *Keyring
+	// AEADMode is the cipher used to seal new objects, AEADModeAESGCM by default. Objects sealed with any of the
+	// built-in modes or this mode can be read.
+	AEADMode AEADMode
+	// SegmentSize enables the segmented streaming format for new objects when greater than zero. Each segment holds
+	// this many bytes of plaintext. It also makes GetObject stream segmented objects, see GetObject for what that
+	// means for callers.
+	SegmentSize int
+	// EncryptMetadata seals the user metadata of new objects into a single cipher-meta entry. Note that S3 limits the
+	// total size of user metadata to 2KB, and sealing adds roughly a third.
+	EncryptMetadata bool
+	// KeyObfuscator, when set, obfuscates every object key before it reaches the underlying S3. ListObjects only
+	// supports the "/" delimiter in this mode.
+	KeyObfuscator *KeyObfuscator
+}
+
+func (s *ClientEncryptedS3) writeMode() AEADMode {
+	if s.AEADMode.New == nil {
+		return AEADModeAESGCM
+	}
+	return s.AEADMode
+}
+
+func (s *ClientEncryptedS3) parseCipherMode(value string) (mode AEADMode, format string, err error) {
+	if s.AEADMode.New != nil {
+		return parseCipherMode(value, append([]AEADMode{s.AEADMode}, builtinAEADModes...))
+	}
+	return parseCipherMode(value, builtinAEADModes)
+}
+
+func (s *ClientEncryptedS3) isStreamed(meta map[string]string) bool {
+	_, format, err := s.parseCipherMode(meta["cipher-mode"])
+	return err == nil && format == cipherFormatStream
+}
+
+func (s *ClientEncryptedS3) storageKey(key string) string {
+	if s.KeyObfuscator != nil {
+		return s.KeyObfuscator.Obfuscate(key)
+	}
+	return key
+}
+
+// writeKeyEncryptionKey returns the key used to wrap the data keys of new objects along with its id, if it has one.
+func (s *ClientEncryptedS3) writeKeyEncryptionKey() (id string, kek KeyEncryptionKey, err error) {
+	if s.Keyring != nil {
+		return s.Keyring.Current()
+	}
+	kek, err = s.keyEncryptionKey()
+	return "", kek, err
+}
+
+// readKeyEncryptionKey returns the key that wrapped the data key of the object with the given metadata.
+func (s *ClientEncryptedS3) readKeyEncryptionKey(meta map[string]string) (KeyEncryptionKey, error) {
+	if id, ok := meta["cipher-key-id"]; ok {
+		if s.Keyring == nil {
+			return nil, fmt.Errorf("object was encrypted with key '%s' but no keyring is configured", id)
+		}
+		return s.Keyring.Get(id)
+	}
+	return s.keyEncryptionKey()
+}
+
+func (s *ClientEncryptedS3) keyEncryptionKey() (KeyEncryptionKey, error) {
+	if s.KeyEncryptionKey != nil {
+		return s.KeyEncryptionKey, nil
+	} else if s.BlockCipher != nil {
+		return &BlockCipherKEK{BlockCipher: s.BlockCipher}, nil
+	}
+	return nil, errors.New("no key encryption key or block cipher configured")
+}
+
+// dataAEAD returns the cipher that the object with the given metadata was sealed with.
+func (s *ClientEncryptedS3) dataAEAD(ctx context.Context, meta map[string]string, mode AEADMode) (cipher.AEAD, error) {
+	encodedKey, ok := meta["cipher-key"]
+	if !ok {
+		if s.BlockCipher == nil {
+			return nil, errors.New("object has no wrapped data key and no block cipher is configured")
+		} else if gcm, err := cipher.NewGCM(s.BlockCipher); err != nil {
+			return nil, fmt.Errorf("failed to initialise gcm cipher: %w", err)
+		} else {
+			return gcm, nil
+		}
+	}
+	if wrappedKey, err := base64.StdEncoding.DecodeString(encodedKey); err != nil {
+		return nil, fmt.Errorf("failed to decode wrapped data key: %w", err)
+	} else if kek, err := s.readKeyEncryptionKey(meta); err != nil {
+		return nil, err
+	} else if dataKey, err := kek.UnwrapKey(ctx, wrappedKey); err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	} else if aead, err := mode.New(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to initialise %s data key cipher: %w", mode.Name, err)
+	} else {
+		return aead, nil
+	}
+}
+
+// openParams validates the cipher metadata of an object and returns the data cipher, the additional data it was sealed
+// with and the metadata to pass on to the caller.
+func (s *ClientEncryptedS3) openParams(ctx context.Context, key string, meta map[string]string) (aead cipher.AEAD, aad []byte, outMeta map[string]string, err error) {
+	mode, format, err := s.parseCipherMode(meta["cipher-mode"])
+	if err != nil {
+		return nil, nil, nil, err
+	} else if format == cipherFormatLegacy {
+		outMeta = meta
+	} else if aad, outMeta, err = authenticatedData(key, meta); err != nil {
+		return nil, nil, nil, err
+	}
+	if aead, err = s.dataAEAD(ctx, outMeta, mode); err != nil {
+		return nil, nil, nil, err
+	} else if outMeta, err = openMeta(aead, key, outMeta); err != nil {
+		return nil, nil, nil, err
+	}
+	return aead, aad, outMeta, nil
+}
+
+// sealMeta moves the user metadata entries into a single sealed cipher-meta entry.
+func sealMeta(aead cipher.AEAD, key string, meta map[string]string) error {
+	userMeta := make(map[string]string)
+	for k, v := range meta {
+		if !strings.HasPrefix(k, "cipher-") {
+			userMeta[k] = v
+			delete(meta, k)
+		}
+	}
+	if raw, err := json.Marshal(userMeta); err != nil {
+		return fmt.Errorf("failed to encode meta: %w", err)
+	} else if sealed, err := sealAEAD(aead, raw, buildAuthenticatedData(key, nil, nil)); err != nil {
+		return err
+	} else {
+		meta["cipher-meta"] = base64.StdEncoding.EncodeToString(sealed)
+		return nil
+	}
+}
+
+// openMeta expands the sealed cipher-meta entry, if any, back into individual entries.
+func openMeta(aead cipher.AEAD, key string, meta map[string]string) (map[string]string, error) {
+	encoded, ok := meta["cipher-meta"]
+	if !ok {
+		return meta, nil
+	}
+	userMeta := make(map[string]string)
+	if sealed, err := base64.StdEncoding.DecodeString(encoded); err != nil {
+		return nil, fmt.Errorf("failed to decode sealed meta: %w", err)
+	} else if raw, err := openAEAD(aead, sealed, buildAuthenticatedData(key, nil, nil)); err != nil {
+		return nil, fmt.Errorf("failed to open sealed meta: %w", err)
+	} else if err := json.Unmarshal(raw, &userMeta); err != nil {
+		return nil, fmt.Errorf("failed to decode sealed meta: %w", err)
+	}
+	for k, v := range meta {
+		if k != "cipher-meta" {
+			userMeta[k] = v
+		}
+	}
+	return userMeta, nil
+}
+
+// streamOpener returns the writer that decrypts the body of a segmented object to dst.
+func (s *ClientEncryptedS3) streamOpener(ctx context.Context, key string, meta map[string]string, dst io.Writer) (*segmentOpener, map[string]string, error) {
+	if aead, aad, outMeta, err := s.openParams(ctx, key, meta); err != nil {
+		return nil, nil, err
+	} else if segmentSize, err := metaSegmentSize(outMeta); err != nil {
+		return nil, nil, err
+	} else {
+		return newSegmentOpener(aead, segmentSize, aad, dst), outMeta, nil
+	}
+}
+
+func metaSegmentSize(meta map[string]string) (int, error) {
+	if v, err := strconv.Atoi(meta["cipher-segment-size"]); err != nil || v <= 0 {
+		return 0, fmt.Errorf("object meta cipher-segment-size '%s' is invalid", meta["cipher-segment-size"])
+	} else {
+		return v, nil
+	}
+}
+
+// GetObject decrypts the object to dst. When SegmentSize is set, segmented objects are decrypted as a stream, which
+// requires fetching the metadata with a HeadObject first. Otherwise the object is buffered in memory.
+//
+// When streaming, each segment is written to dst as soon as it has been authenticated, before the final segment has
+// been seen. If the object was truncated, dst receives the leading segments and the error is only returned at the
+// end, so callers must not act on what was written to dst unless GetObject returns no error.
+func (s *ClientEncryptedS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
+	if s.SegmentSize > 0 {
+		if _, headMeta, err := s.S3.HeadObject(ctx, s.storageKey(key)); err != nil {
+			return nil, err
+		} else if s.isStreamed(headMeta) {
+			if opener, outMeta, err := s.streamOpener(ctx, key, headMeta, dst); err != nil {
+				return nil, err
+			} else if _, err := s.S3.GetObject(ctx, s.storageKey(key), opener); err != nil {
+				return nil, err
+			} else if err := opener.Close(); err != nil {
+				return nil, err
+			} else {
+				return outMeta, nil
+			}
+		}
+	}
+
+	buff := new(bytes.Buffer)
+	if meta, err = s.S3.GetObject(ctx, s.storageKey(key), buff); err != nil {
+		return nil, err
+	} else if s.isStreamed(meta) {
+		if opener, outMeta, err := s.streamOpener(ctx, key, meta, dst); err != nil {
+			return nil, err
+		} else if _, err := opener.Write(buff.Bytes()); err != nil {
+			return nil, err
+		} else if err := opener.Close(); err != nil {
+			return nil, err
+		} else {
+			return outMeta, nil
+		}
+	} else if aead, aad, outMeta, err := s.openParams(ctx, key, meta); err != nil {
+		return nil, err
+	} else if bo, err := openAEAD(aead, buff.Bytes(), aad); err != nil {
+		return nil, err
+	} else if _, err = dst.Write(bo); err != nil {
+		return nil, fmt.Errorf("failed to write: %w", err)
+	} else {
+		return outMeta, nil
+	}
+}
+
+// GetObjectRange decrypts part of an object to dst. For segmented objects stored in a backend that supports ranged
+// reads only the segments covering the range are downloaded, otherwise the whole object is read and decrypted.
+func (s *ClientEncryptedS3) GetObjectRange(ctx context.Context, key string, offset, length int64, dst io.Writer) (meta map[string]string, err error) {
+	size, headMeta, err := s.S3.HeadObject(ctx, s.storageKey(key))
+	if err != nil {
+		return nil, err
+	}
+	rg, ok := s.S3.(RangeGetter)
+	if !ok || !s.isStreamed(headMeta) {
+		buff := new(bytes.Buffer)
+		if meta, err = s.GetObject(ctx, key, buff); err != nil {
+			return nil, err
+		}
+		return meta, writeRange(buff.Bytes(), offset, length, dst)
+	}
+
+	aead, aad, outMeta, err := s.openParams(ctx, key, headMeta)
+	if err != nil {
+		return nil, err
+	}
+	segmentSize, err := metaSegmentSize(outMeta)
+	if err != nil {
+		return nil, err
+	}
+	totalSegments, plaintextSize, err := segmentCount(aead.NonceSize(), aead.Overhead(), segmentSize, size)
+	if err != nil {
+		return nil, err
+	}
+	prefixSize, sealedSegmentSize := int64(streamPrefixSize(aead)), int64(segmentSize+aead.Overhead())
+	if offset < 0 || offset >= plaintextSize {
+		return nil, fmt.Errorf("%w: offset %d of object with size %d", ErrInvalidRange, offset, plaintextSize)
+	}
+	end := plaintextSize
+	if length > 0 && offset+length < end {
+		end = offset + length
+	}
+	first, last := offset/int64(segmentSize), (end-1)/int64(segmentSize)
+
+	prefix := new(bytes.Buffer)
+	if _, err := rg.GetObjectRange(ctx, s.storageKey(key), 0, prefixSize, prefix); err != nil {
+		return nil, err
+	}
+	sealed := new(bytes.Buffer)
+	if _, err := rg.GetObjectRange(ctx, s.storageKey(key), prefixSize+first*sealedSegmentSize, (last-first+1)*sealedSegmentSize, sealed); err != nil {
+		return nil, err
+	}
+	if plain, err := openSegmentRange(aead, segmentSize, aad, prefix.Bytes(), first, totalSegments, sealed.Bytes()); err != nil {
+		return nil, err
+	} else if _, err := dst.Write(plain[offset-first*int64(segmentSize) : end-first*int64(segmentSize)]); err != nil {
+		return nil, fmt.Errorf("failed to write: %w", err)
+	}
+	return outMeta, nil
+}
+
+// writeRange writes the given range of data to dst with the same semantics as RangeGetter.
+func writeRange(data []byte, offset, length int64, dst io.Writer) error {
+	if offset < 0 || offset >= int64(len(data)) {
+		return fmt.Errorf("%w: offset %d of object with size %d", ErrInvalidRange, offset, len(data))
+	}
+	end := int64(len(data))
+	if length > 0 && offset+length < end {
+		end = offset + length
+	}
+	_, err := dst.Write(data[offset:end])
+	return err
+}
+
+func (s *ClientEncryptedS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+	kekId, kek, err := s.writeKeyEncryptionKey()
+	if err != nil {
+		return err
+	}
+	wrappedKey, err := kek.WrapKey(ctx, dataKey)
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	mode := s.writeMode()
+	aead, err := mode.New(dataKey)
+	if err != nil {
+		return fmt.Errorf("failed to initialise %s data key cipher: %w", mode.Name, err)
+	}
+
+	// cipher entries left over from a previous read are replaced
+	meta = lowerKeys(meta)
+	maps.DeleteFunc(meta, func(k string, _ string) bool {
+		return strings.HasPrefix(k, "cipher-")
+	})
+	if s.EncryptMetadata {
+		if err := sealMeta(aead, key, meta); err != nil {
+			return err
+		}
+	}
+	meta["cipher-key"] = base64.StdEncoding.EncodeToString(wrappedKey)
+	if kekId != "" {
+		meta["cipher-key-id"] = kekId
+	}
+
+	if s.SegmentSize <= 0 {
+		n, err := io.ReadAll(body)
+		if err != nil {
+			return fmt.Errorf("failed to buffer data: %w", err)
+		}
+		meta["cipher-mode"] = cipherMode(mode, cipherFormatV2)
+		meta["cipher-plaintext-size"] = strconv.Itoa(len(n))
+		aad := sealAuthenticatedData(key, meta)
+		if sealed, err := sealAEAD(aead, n, aad); err != nil {
+			return err
+		} else {
+			return s.S3.PutObject(ctx, s.storageKey(key), meta, bytes.NewReader(sealed))
+		}
+	}
+
+	meta["cipher-mode"] = cipherMode(mode, cipherFormatStream)
+	meta["cipher-segment-size"] = strconv.Itoa(s.SegmentSize)
+	aad := sealAuthenticatedData(key, meta)
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = pw.CloseWithError(sealSegments(aead, s.SegmentSize, aad, body, pw))
+	}()
+	err = s.S3.PutObject(ctx, s.storageKey(key), meta, pr)
+	_ = pr.Close()
+	<-done
+	return err
+}
+
+// ReEncrypt walks every object under the prefix and rewrites those that are not encrypted under the current key of the
+// Keyring. It is intended to be run in the background after rotating keys, and returns the number of rewritten
+// objects. Objects that are concurrently deleted are skipped. Writes that race with the re-encryption of the same object
+// may be overwritten with the older content, so it should run while writers of mutable objects are quiet.
+func (s *ClientEncryptedS3) ReEncrypt(ctx context.Context, prefix string) (rewritten int, err error) {
+	currentId, _, err := s.writeKeyEncryptionKey()
+	if err != nil {
+		return 0, err
+	}
+	keys, _, _, err := s.ListObjects(ctx, prefix, "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list objects: %w", err)
+	}
+	for _, key := range keys {
+		if _, meta, err := s.S3.HeadObject(ctx, s.storageKey(key)); errors.Is(err, ErrObjectNotFound) {
+			continue
+		} else if err != nil {
+			return rewritten, fmt.Errorf("failed to head object '%s': %w", key, err)
+		} else if _, wrapped := meta["cipher-key"]; wrapped && meta["cipher-key-id"] == currentId {
+			continue
+		}
+		buff := new(bytes.Buffer)
+		if meta, err := s.GetObject(ctx, key, buff); errors.Is(err, ErrObjectNotFound) {
+			continue
+		} else if err != nil {
+			return rewritten, fmt.Errorf("failed to read object '%s': %w", key, err)
+		} else if err := s.PutObject(ctx, key, meta, buff); err != nil {
+			return rewritten, fmt.Errorf("failed to rewrite object '%s': %w", key, err)
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+// plaintextSize returns the plaintext size of an object, calculated from the ciphertext size and the overhead of its
+// cipher mode. The cipher-plaintext-size entry isn't authenticated until the object is read, so it is only checked
+// against the calculated size.
+func (s *ClientEncryptedS3) plaintextSize(meta map[string]string, size int64) (int64, error) {
+	mode, format, err := s.parseCipherMode(meta["cipher-mode"])
+	if err != nil {
+		return 0, err
+	}
+	nonceSize, overhead, err := mode.sizes()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if format != cipherFormatStream {
+		if n = size - int64(nonceSize+overhead); n < 0 {
+			return 0, fmt.Errorf("ciphertext size %d is too small", size)
+		}
+	} else if segmentSize, err := metaSegmentSize(meta); err != nil {
+		return 0, err
+	} else if _, n, err = segmentCount(nonceSize, overhead, segmentSize, size); err != nil {
+		return 0, err
+	}
+	if v, ok := meta["cipher-plaintext-size"]; ok && v != strconv.FormatInt(n, 10) {
+		return 0, fmt.Errorf("object meta cipher-plaintext-size '%s' doesn't match the ciphertext size %d", v, size)
+	}
+	return n, nil
+}
+
+// listedPlaintextSize calculates the plaintext size of a listed object, assuming that it was written with the same
+// mode and settings as new objects since ListObjects doesn't return metadata.
+func (s *ClientEncryptedS3) listedPlaintextSize(size int64) int64 {
+	nonceSize, overhead, err := s.writeMode().sizes()
+	if err != nil {
+		return 0
+	} else if s.SegmentSize <= 0 {
+		return max(0, size-int64(nonceSize+overhead))
+	} else if _, n, err := segmentCount(nonceSize, overhead, s.SegmentSize, size); err != nil {
+		return 0
+	} else {
+		return n
+	}
+}
+
+// HeadObject returns the plaintext size and metadata of the object. Like GetObject, only the entries listed in
+// cipher-aad are returned, and sealed metadata is opened, which requires unwrapping the data key. The internal cipher-
+// entries are removed. HEAD doesn't read the ciphertext, so the values of the returned entries are only authenticated
+// when the object is read with GetObject, and objects written by older versions have no cipher-aad to filter by.
+func (s *ClientEncryptedS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
+	if size, meta, err = s.S3.HeadObject(ctx, s.storageKey(key)); err != nil {
+		return 0, nil, err
+	} else if size, err = s.plaintextSize(meta, size); err != nil {
+		return 0, nil, err
+	} else if _, format, err := s.parseCipherMode(meta["cipher-mode"]); err != nil {
+		return 0, nil, err
+	} else if _, ok := meta["cipher-meta"]; ok {
+		if _, _, meta, err = s.openParams(ctx, key, meta); err != nil {
+			return 0, nil, err
+		}
+	} else if format != cipherFormatLegacy {
+		if _, meta, err = authenticatedData(key, meta); err != nil {
+			return 0, nil, err
+		}
+	}
+	maps.DeleteFunc(meta, func(k string, _ string) bool {
+		return strings.HasPrefix(k, "cipher-")
+	})
+	return size, meta, nil
+}
+
+func (s *ClientEncryptedS3) DeleteObject(ctx context.Context, key string) error {
+	return s.S3.DeleteObject(ctx, s.storageKey(key))
+}
+
+// ListObjects lists the underlying objects with their plaintext sizes. See listedPlaintextSize for the limitations.
+func (s *ClientEncryptedS3) ListObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	if keys, sizes, prefixes, err = s.listStorageObjects(ctx, prefix, delimiter); err != nil {
+		return nil, nil, nil, err
+	}
+	for i, size := range sizes {
+		sizes[i] = s.listedPlaintextSize(size)
+	}
+	return keys, sizes, prefixes, nil
+}
+
+// listStorageObjects lists the underlying objects. With a KeyObfuscator only the complete segments of the prefix can be
+// obfuscated, so any trailing partial segment is filtered after revealing the listed keys.
+func (s *ClientEncryptedS3) listStorageObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	if s.KeyObfuscator == nil {
+		return s.S3.ListObjects(ctx, prefix, delimiter)
+	} else if delimiter != "" && delimiter != "/" {
+		return nil, nil, nil, fmt.Errorf("delimiter '%s' is not supported with key obfuscation", delimiter)
+	}
+	parent := prefix[:strings.LastIndex(prefix, "/")+1]
+	storageKeys, storageSizes, storagePrefixes, err := s.S3.ListObjects(ctx, s.KeyObfuscator.Obfuscate(parent), delimiter)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keys, sizes, prefixes = make([]string, 0, len(storageKeys)), make([]int64, 0, len(storageSizes)), make([]string, 0, len(storagePrefixes))
+	for i, storageKey := range storageKeys {
+		if key, err := s.KeyObfuscator.Reveal(storageKey); err != nil {
+			return nil, nil, nil, err
+		} else if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+			sizes = append(sizes, storageSizes[i])
+		}
+	}
+	for _, storagePrefix := range storagePrefixes {
+		if p, err := s.KeyObfuscator.Reveal(storagePrefix); err != nil {
+			return nil, nil, nil, err
+		} else if strings.HasPrefix(p, prefix) {
+			prefixes = append(prefixes, p)
+		}
+	}
+	sort.Strings(prefixes)
+	sort.Sort(&twoSliceSorter{keySlice: keys, sizeSlice: sizes})
+	return keys, sizes, prefixes, nil
+}
+
+var _ S3 = (*ClientEncryptedS3)(nil)
+var _ RangeGetter = (*ClientEncryptedS3)(nil)
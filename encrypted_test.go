@@ -0,0 +1,260 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestBlockCipher(t *testing.T) cipher.Block {
+	t.Helper()
+	rk := make([]byte, 16)
+	_, err := rand.Read(rk)
+	MustAssertEqual(t, err, nil)
+	bc, err := aes.NewCipher(rk)
+	MustAssertEqual(t, err, nil)
+	return bc
+}
+
+type countingKEK struct {
+	KeyEncryptionKey
+	wraps, unwraps int
+}
+
+func (c *countingKEK) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	c.wraps++
+	return c.KeyEncryptionKey.WrapKey(ctx, dataKey)
+}
+
+func (c *countingKEK) UnwrapKey(ctx context.Context, wrappedKey []byte) ([]byte, error) {
+	c.unwraps++
+	return c.KeyEncryptionKey.UnwrapKey(ctx, wrappedKey)
+}
+
+func TestClientEncryptedS3_kek(t *testing.T) {
+	testS3Interface(t, &ClientEncryptedS3{
+		S3:               &InMemoryS3{},
+		KeyEncryptionKey: &BlockCipherKEK{BlockCipher: newTestBlockCipher(t)},
+	})
+}
+
+func TestClientEncryptedS3_data_key_per_object(t *testing.T) {
+	inner := &InMemoryS3{}
+	kek := &countingKEK{KeyEncryptionKey: &BlockCipherKEK{BlockCipher: newTestBlockCipher(t)}}
+	s := &ClientEncryptedS3{S3: inner, KeyEncryptionKey: kek}
+	AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("same")), nil)
+	AssertEqual(t, s.PutObject(context.Background(), "b", nil, strings.NewReader("same")), nil)
+	AssertEqual(t, kek.wraps, 2)
+
+	_, ma, err := inner.HeadObject(context.Background(), "a")
+	AssertEqual(t, err, nil)
+	_, mb, err := inner.HeadObject(context.Background(), "b")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, ma["cipher-key"] != "" && ma["cipher-key"] != mb["cipher-key"], true)
+
+	buff := new(bytes.Buffer)
+	_, err = s.GetObject(context.Background(), "b", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "same")
+	AssertEqual(t, kek.unwraps, 1)
+}
+
+func TestClientEncryptedS3_wrong_kek(t *testing.T) {
+	inner := &InMemoryS3{}
+	s := &ClientEncryptedS3{S3: inner, BlockCipher: newTestBlockCipher(t)}
+	AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("data")), nil)
+	s.BlockCipher = newTestBlockCipher(t)
+	_, err := s.GetObject(context.Background(), "a", new(bytes.Buffer))
+	AssertErrorEqual(t, err, "failed to unwrap data key: failed to decrypt: cipher: message authentication failed")
+}
+
+func TestClientEncryptedS3_legacy_direct_encryption(t *testing.T) {
+	inner := &InMemoryS3{}
+	bc := newTestBlockCipher(t)
+	sealed, err := sealGCM(bc, []byte("legacy data"), nil)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, inner.PutObject(context.Background(), "a", map[string]string{"cipher-mode": "GCM"}, bytes.NewReader(sealed)), nil)
+
+	s := &ClientEncryptedS3{S3: inner, BlockCipher: bc}
+	buff := new(bytes.Buffer)
+	_, err = s.GetObject(context.Background(), "a", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "legacy data")
+}
+
+func TestClientEncryptedS3_keyring_rotation(t *testing.T) {
+	inner := &InMemoryS3{}
+	legacy := newTestBlockCipher(t)
+	keyring := &Keyring{CurrentKeyId: "k1", Keys: map[string]KeyEncryptionKey{
+		"k1": &BlockCipherKEK{BlockCipher: newTestBlockCipher(t)},
+	}}
+	s := &ClientEncryptedS3{S3: inner, BlockCipher: legacy}
+	AssertEqual(t, s.PutObject(context.Background(), "docs/legacy", nil, strings.NewReader("legacy")), nil)
+
+	s.Keyring = keyring
+	AssertEqual(t, s.PutObject(context.Background(), "docs/a", map[string]string{"x": "y"}, strings.NewReader("a")), nil)
+	_, m, err := inner.HeadObject(context.Background(), "docs/a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, m["cipher-key-id"], "k1")
+
+	keyring.Keys["k2"] = &BlockCipherKEK{BlockCipher: newTestBlockCipher(t)}
+	keyring.CurrentKeyId = "k2"
+	AssertEqual(t, s.PutObject(context.Background(), "docs/b", nil, strings.NewReader("b")), nil)
+	AssertEqual(t, s.PutObject(context.Background(), "other/c", nil, strings.NewReader("c")), nil)
+
+	// both old and new keys can still be read
+	for k, v := range map[string]string{"docs/legacy": "legacy", "docs/a": "a", "docs/b": "b"} {
+		buff := new(bytes.Buffer)
+		_, err := s.GetObject(context.Background(), k, buff)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, buff.String(), v)
+	}
+
+	n, err := s.ReEncrypt(context.Background(), "docs/")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 2)
+	n, err = s.ReEncrypt(context.Background(), "docs/")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 0)
+
+	// retire the old keys entirely and check everything is still readable
+	delete(keyring.Keys, "k1")
+	s.BlockCipher = nil
+	for k, v := range map[string]string{"docs/legacy": "legacy", "docs/a": "a", "docs/b": "b"} {
+		buff := new(bytes.Buffer)
+		m, err := s.GetObject(context.Background(), k, buff)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, buff.String(), v)
+		AssertEqual(t, m["cipher-key-id"], "k2")
+	}
+	buff := new(bytes.Buffer)
+	m, err = s.GetObject(context.Background(), "docs/a", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, m["x"], "y")
+}
+
+func TestClientEncryptedS3_keyring_missing_key(t *testing.T) {
+	inner := &InMemoryS3{}
+	s := &ClientEncryptedS3{S3: inner, Keyring: &Keyring{CurrentKeyId: "k1", Keys: map[string]KeyEncryptionKey{}}}
+	AssertErrorEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("a")), "current key: key 'k1' not found in keyring")
+}
+
+func TestClientEncryptedS3_bound_to_key(t *testing.T) {
+	inner := &InMemoryS3{}
+	s := &ClientEncryptedS3{S3: inner, BlockCipher: newTestBlockCipher(t)}
+	AssertEqual(t, s.PutObject(context.Background(), "docs/a", map[string]string{"Peer": "1"}, strings.NewReader("a")), nil)
+	AssertEqual(t, s.PutObject(context.Background(), "docs/b", nil, strings.NewReader("b")), nil)
+
+	_, m, err := inner.HeadObject(context.Background(), "docs/a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, m["cipher-mode"], "GCM-v2")
+	AssertEqual(t, m["cipher-aad"], "cipher-key,cipher-mode,cipher-plaintext-size,peer")
+
+	t.Run("swapped ciphertext", func(t *testing.T) {
+		raw := new(bytes.Buffer)
+		m, err := inner.GetObject(context.Background(), "docs/a", raw)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, inner.PutObject(context.Background(), "docs/swapped", m, raw), nil)
+		_, err = s.GetObject(context.Background(), "docs/swapped", new(bytes.Buffer))
+		AssertErrorEqual(t, err, "failed to decrypt: cipher: message authentication failed")
+	})
+
+	t.Run("tampered meta", func(t *testing.T) {
+		raw := new(bytes.Buffer)
+		m, err := inner.GetObject(context.Background(), "docs/a", raw)
+		AssertEqual(t, err, nil)
+		m["peer"] = "2"
+		AssertEqual(t, inner.PutObject(context.Background(), "docs/a", m, raw), nil)
+		_, err = s.GetObject(context.Background(), "docs/a", new(bytes.Buffer))
+		AssertErrorEqual(t, err, "failed to decrypt: cipher: message authentication failed")
+	})
+
+	t.Run("unauthenticated meta is dropped", func(t *testing.T) {
+		raw := new(bytes.Buffer)
+		m, err := inner.GetObject(context.Background(), "docs/b", raw)
+		AssertEqual(t, err, nil)
+		m["extra"] = "x"
+		AssertEqual(t, inner.PutObject(context.Background(), "docs/b", m, raw), nil)
+		buff := new(bytes.Buffer)
+		m, err = s.GetObject(context.Background(), "docs/b", buff)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, buff.String(), "b")
+		_, ok := m["extra"]
+		AssertEqual(t, ok, false)
+	})
+
+	t.Run("head only returns authenticated meta", func(t *testing.T) {
+		raw := new(bytes.Buffer)
+		m, err := inner.GetObject(context.Background(), "docs/b", raw)
+		AssertEqual(t, err, nil)
+		m["injected"] = "yes"
+		AssertEqual(t, inner.PutObject(context.Background(), "docs/injected", m, raw), nil)
+		_, m, err = s.HeadObject(context.Background(), "docs/injected")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, m, map[string]string{})
+	})
+}
+
+func TestClientEncryptedS3_legacy_envelope_without_aad(t *testing.T) {
+	inner := &InMemoryS3{}
+	bc := newTestBlockCipher(t)
+	dataKey := make([]byte, 32)
+	_, _ = rand.Read(dataKey)
+	wrapped, err := (&BlockCipherKEK{BlockCipher: bc}).WrapKey(context.Background(), dataKey)
+	AssertEqual(t, err, nil)
+	dataBlock, err := aes.NewCipher(dataKey)
+	AssertEqual(t, err, nil)
+	sealed, err := sealGCM(dataBlock, []byte("old"), nil)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, inner.PutObject(context.Background(), "a", map[string]string{
+		"cipher-mode": "GCM",
+		"cipher-key":  base64.StdEncoding.EncodeToString(wrapped),
+	}, bytes.NewReader(sealed)), nil)
+
+	buff := new(bytes.Buffer)
+	_, err = (&ClientEncryptedS3{S3: inner, BlockCipher: bc}).GetObject(context.Background(), "a", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "old")
+}
+
+func TestClientEncryptedS3_legacy_plaintext_size(t *testing.T) {
+	inner := &InMemoryS3{}
+	bc := newTestBlockCipher(t)
+	sealed, err := sealGCM(bc, []byte("legacy data"), nil)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, inner.PutObject(context.Background(), "a", map[string]string{"cipher-mode": "GCM"}, bytes.NewReader(sealed)), nil)
+
+	s := &ClientEncryptedS3{S3: inner, BlockCipher: bc}
+	n, _, err := s.HeadObject(context.Background(), "a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 11)
+	_, sizes, _, err := s.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, sizes, []int64{11})
+}
+
+func TestClientEncryptedS3_tampered_plaintext_size(t *testing.T) {
+	for _, segmentSize := range []int{0, 4} {
+		inner := &InMemoryS3{}
+		s := &ClientEncryptedS3{S3: inner, BlockCipher: newTestBlockCipher(t), SegmentSize: segmentSize}
+		AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("hello world")), nil)
+		n, _, err := s.HeadObject(context.Background(), "a")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, n, int64(11))
+
+		raw := new(bytes.Buffer)
+		m, err := inner.GetObject(context.Background(), "a", raw)
+		AssertEqual(t, err, nil)
+		m["cipher-plaintext-size"] = "999"
+		size := raw.Len()
+		AssertEqual(t, inner.PutObject(context.Background(), "a", m, raw), nil)
+		_, _, err = s.HeadObject(context.Background(), "a")
+		AssertErrorEqual(t, err, "object meta cipher-plaintext-size '999' doesn't match the ciphertext size "+strconv.Itoa(size))
+	}
+}
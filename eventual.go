@@ -0,0 +1,104 @@
+package automerge_s3_sync
+
+import (
+	"time"
+)
+
+// EventualConsistency configures InMemoryS3 to behave like a storage provider with list-after-write lag. A write or
+// delete only becomes visible once Delay has elapsed on the Clock and Operations further operations have been
+// performed against the store. Zero values disable the respective condition.
+type EventualConsistency struct {
+	// Delay is the time after a write or delete before it becomes visible.
+	Delay time.Duration
+	// Operations is the number of subsequent operations after a write or delete before it becomes visible.
+	Operations int
+	// AffectsReads applies the lag to GetObject and HeadObject too, not just ListObjects.
+	AffectsReads bool
+	// Clock is used to measure Delay. Defaults to time.Now.
+	Clock func() time.Time
+}
+
+func (e *EventualConsistency) now() time.Time {
+	if e.Clock != nil {
+		return e.Clock()
+	}
+	return time.Now()
+}
+
+type pendingVisibility struct {
+	key     string
+	deleted bool
+	obj     []byte
+	meta    map[string]string
+	at      time.Time
+	op      int
+}
+
+// lockForRead acquires the appropriate lock for a read operation and returns the matching unlock function. Reads
+// mutate the visibility state when eventual consistency is enabled so they need the write lock.
+func (i *InMemoryS3) lockForRead() func() {
+	if i.Eventual == nil {
+		i.mux.RLock()
+		return i.mux.RUnlock
+	}
+	i.mux.Lock()
+	i.tick()
+	return i.mux.Unlock
+}
+
+// tick counts an operation and promotes any pending changes that are now due. Must be called with the write lock held.
+func (i *InMemoryS3) tick() {
+	if i.Eventual == nil {
+		return
+	}
+	if i.visibleObjects == nil {
+		i.visibleObjects = make(map[string][]byte, len(i.objects))
+		i.visibleMetas = make(map[string]map[string]string, len(i.metas))
+		for k, v := range i.objects {
+			i.visibleObjects[k] = v
+			i.visibleMetas[k] = i.metas[k]
+		}
+	}
+	i.ops++
+	now := i.Eventual.now()
+	for len(i.pending) > 0 {
+		p := i.pending[0]
+		if now.Sub(p.at) < i.Eventual.Delay || i.ops-p.op < i.Eventual.Operations {
+			break
+		}
+		if p.deleted {
+			delete(i.visibleObjects, p.key)
+			delete(i.visibleMetas, p.key)
+		} else {
+			i.visibleObjects[p.key] = p.obj
+			i.visibleMetas[p.key] = p.meta
+		}
+		i.pending = i.pending[1:]
+	}
+}
+
+// recordChange queues a write or delete of key for delayed visibility. Must be called with the write lock held.
+func (i *InMemoryS3) recordChange(key string, deleted bool) {
+	if i.Eventual == nil {
+		return
+	}
+	i.pending = append(i.pending, pendingVisibility{
+		key: key, deleted: deleted, obj: i.objects[key], meta: i.metas[key], at: i.Eventual.now(), op: i.ops,
+	})
+}
+
+// listView returns the objects that ListObjects can observe.
+func (i *InMemoryS3) listView() (map[string][]byte, map[string]map[string]string) {
+	if i.Eventual == nil {
+		return i.objects, i.metas
+	}
+	return i.visibleObjects, i.visibleMetas
+}
+
+// readView returns the objects that GetObject and HeadObject can observe.
+func (i *InMemoryS3) readView() (map[string][]byte, map[string]map[string]string) {
+	if i.Eventual == nil || !i.Eventual.AffectsReads {
+		return i.objects, i.metas
+	}
+	return i.visibleObjects, i.visibleMetas
+}
@@ -0,0 +1,67 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInMemoryS3_eventual_immediate(t *testing.T) {
+	testS3Interface(t, &InMemoryS3{Eventual: &EventualConsistency{}})
+}
+
+func TestInMemoryS3_eventual_delay(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &InMemoryS3{Eventual: &EventualConsistency{Delay: time.Second, Clock: func() time.Time {
+		return now
+	}}}
+	AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("x")), nil)
+
+	k, _, _, err := s.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, k, []string{})
+	_, err = s.GetObject(context.Background(), "a", io.Discard)
+	AssertEqual(t, err, nil)
+
+	now = now.Add(time.Second)
+	k, _, _, err = s.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, k, []string{"a"})
+
+	AssertEqual(t, s.DeleteObject(context.Background(), "a"), nil)
+	k, _, _, err = s.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, k, []string{"a"})
+	_, err = s.GetObject(context.Background(), "a", io.Discard)
+	AssertErrorIs(t, err, ErrObjectNotFound)
+
+	now = now.Add(time.Second)
+	k, _, _, err = s.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, k, []string{})
+}
+
+func TestInMemoryS3_eventual_operations_and_reads(t *testing.T) {
+	s := &InMemoryS3{Eventual: &EventualConsistency{Operations: 2, AffectsReads: true}}
+	AssertEqual(t, s.PutObject(context.Background(), "a", map[string]string{"x": "y"}, strings.NewReader("x")), nil)
+
+	_, _, err := s.HeadObject(context.Background(), "a")
+	AssertErrorIs(t, err, ErrObjectNotFound)
+
+	n, m, err := s.HeadObject(context.Background(), "a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 1)
+	AssertEqual(t, m, map[string]string{"x": "y"})
+}
+
+func TestInMemoryS3_eventual_existing_objects_visible(t *testing.T) {
+	s := &InMemoryS3{}
+	AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("x")), nil)
+	s.Eventual = &EventualConsistency{Operations: 100}
+	AssertEqual(t, s.PutObject(context.Background(), "b", nil, strings.NewReader("x")), nil)
+	k, _, _, err := s.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, k, []string{"a"})
+}
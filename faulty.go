@@ -0,0 +1,225 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInjectedFault is returned (wrapped) by FaultyS3 when a fault rule fires.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultKind is the type of misbehaviour injected by a FaultRule.
+type FaultKind int
+
+const (
+	// FaultError fails the operation without calling the underlying S3.
+	FaultError FaultKind = iota
+	// FaultLatency delays the operation by the rule's Latency and then continues normally.
+	FaultLatency
+	// FaultSlowDown fails the operation with ErrSlowDown as if the provider returned 503 SlowDown.
+	FaultSlowDown
+	// FaultPartialWrite stores only the first half of a PutObject body and then fails.
+	FaultPartialWrite
+	// FaultTruncatedRead writes only the first half of a GetObject body to the destination and then fails.
+	FaultTruncatedRead
+	// FaultDroppedPut commits a PutObject to the underlying S3 but reports a failure to the caller.
+	FaultDroppedPut
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultError:
+		return "error"
+	case FaultLatency:
+		return "latency"
+	case FaultSlowDown:
+		return "slow-down"
+	case FaultPartialWrite:
+		return "partial-write"
+	case FaultTruncatedRead:
+		return "truncated-read"
+	case FaultDroppedPut:
+		return "dropped-put"
+	default:
+		return fmt.Sprintf("FaultKind(%d)", int(k))
+	}
+}
+
+func (k FaultKind) appliesTo(op S3Operation) bool {
+	switch k {
+	case FaultPartialWrite, FaultDroppedPut:
+		return op == OpPutObject
+	case FaultTruncatedRead:
+		return op == OpGetObject
+	default:
+		return true
+	}
+}
+
+// FaultRule describes when and how FaultyS3 should misbehave.
+type FaultRule struct {
+	// Kind is the fault to inject.
+	Kind FaultKind
+	// Ops limits the rule to these operations. Empty matches every operation the Kind applies to.
+	Ops []S3Operation
+	// KeyPrefix limits the rule to object keys (or list prefixes) starting with this prefix.
+	KeyPrefix string
+	// Probability is the chance of the rule firing when it matches. Values <= 0 or >= 1 always fire.
+	Probability float64
+	// Times limits how often the rule fires. 0 means unlimited.
+	Times int
+	// Latency is the delay injected by FaultLatency rules.
+	Latency time.Duration
+	// Err overrides the error returned by FaultError rules.
+	Err error
+
+	fired atomic.Int64
+}
+
+// Fired returns the number of times the rule has been triggered.
+func (r *FaultRule) Fired() int {
+	return int(r.fired.Load())
+}
+
+func (r *FaultRule) matches(op S3Operation, key string) bool {
+	if !r.Kind.appliesTo(op) {
+		return false
+	} else if len(r.Ops) > 0 && !slices.Contains(r.Ops, op) {
+		return false
+	} else if !strings.HasPrefix(key, r.KeyPrefix) {
+		return false
+	} else if r.Times > 0 && r.Fired() >= r.Times {
+		return false
+	}
+	return true
+}
+
+// FaultyS3 wraps an S3 and injects faults according to its Rules. Probabilistic rules are driven by a random source
+// seeded from Seed so that a given sequence of operations always produces the same faults.
+type FaultyS3 struct {
+	S3
+	Rules []*FaultRule
+	Seed  uint64
+
+	mux sync.Mutex
+	rng *rand.Rand
+}
+
+// evaluate returns the total latency to inject and the first non-latency rule that fired, if any.
+func (f *FaultyS3) evaluate(op S3Operation, key string) (latency time.Duration, fault *FaultRule) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.rng == nil {
+		f.rng = rand.New(rand.NewPCG(f.Seed, f.Seed))
+	}
+	for _, rule := range f.Rules {
+		if !rule.matches(op, key) {
+			continue
+		}
+		if p := rule.Probability; p > 0 && p < 1 && f.rng.Float64() >= p {
+			continue
+		}
+		if rule.Kind == FaultLatency {
+			rule.fired.Add(1)
+			latency += rule.Latency
+		} else if fault == nil {
+			rule.fired.Add(1)
+			fault = rule
+		}
+	}
+	return latency, fault
+}
+
+// before applies latency and immediate failures. It returns the rule that needs operation specific handling, if any.
+func (f *FaultyS3) before(ctx context.Context, op S3Operation, key string) (*FaultRule, error) {
+	latency, fault := f.evaluate(op, key)
+	if err := sleepContext(ctx, latency); err != nil {
+		return nil, err
+	}
+	if fault == nil {
+		return nil, nil
+	}
+	switch fault.Kind {
+	case FaultError:
+		if fault.Err != nil {
+			return nil, fault.Err
+		}
+		return nil, fmt.Errorf("%w: %s %s failed", ErrInjectedFault, op, key)
+	case FaultSlowDown:
+		return nil, fmt.Errorf("%w: %w: %s %s: 503 SlowDown", ErrInjectedFault, ErrSlowDown, op, key)
+	}
+	return fault, nil
+}
+
+func (f *FaultyS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
+	fault, err := f.before(ctx, OpGetObject, key)
+	if err != nil {
+		return nil, err
+	} else if fault == nil {
+		return f.S3.GetObject(ctx, key, dst)
+	}
+	buff := new(bytes.Buffer)
+	if meta, err = f.S3.GetObject(ctx, key, buff); err != nil {
+		return meta, err
+	} else if _, err := dst.Write(buff.Bytes()[:buff.Len()/2]); err != nil {
+		return meta, err
+	}
+	return meta, fmt.Errorf("%w: truncated read of %s: %w", ErrInjectedFault, key, io.ErrUnexpectedEOF)
+}
+
+func (f *FaultyS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
+	if _, err := f.before(ctx, OpHeadObject, key); err != nil {
+		return 0, nil, err
+	}
+	return f.S3.HeadObject(ctx, key)
+}
+
+func (f *FaultyS3) ListObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	if _, err := f.before(ctx, OpListObjects, prefix); err != nil {
+		return nil, nil, nil, err
+	}
+	return f.S3.ListObjects(ctx, prefix, delimiter)
+}
+
+func (f *FaultyS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	fault, err := f.before(ctx, OpPutObject, key)
+	if err != nil {
+		return err
+	} else if fault == nil {
+		return f.S3.PutObject(ctx, key, meta, body)
+	}
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to buffer data: %w", err)
+	}
+	switch fault.Kind {
+	case FaultPartialWrite:
+		if err := f.S3.PutObject(ctx, key, meta, bytes.NewReader(raw[:len(raw)/2])); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: partial write of %s", ErrInjectedFault, key)
+	default:
+		if err := f.S3.PutObject(ctx, key, meta, bytes.NewReader(raw)); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: response to put of %s was dropped", ErrInjectedFault, key)
+	}
+}
+
+func (f *FaultyS3) DeleteObject(ctx context.Context, key string) error {
+	if _, err := f.before(ctx, OpDeleteObject, key); err != nil {
+		return err
+	}
+	return f.S3.DeleteObject(ctx, key)
+}
+
+var _ S3 = (*FaultyS3)(nil)
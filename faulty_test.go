@@ -0,0 +1,105 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultyS3_no_rules(t *testing.T) {
+	testS3Interface(t, &FaultyS3{S3: &InMemoryS3{}})
+}
+
+func TestFaultyS3_error(t *testing.T) {
+	custom := errors.New("boom")
+	inner := &InMemoryS3{}
+	f := &FaultyS3{S3: inner, Rules: []*FaultRule{
+		{Kind: FaultError, Ops: []S3Operation{OpPutObject}, KeyPrefix: "a/", Times: 1},
+		{Kind: FaultError, Ops: []S3Operation{OpHeadObject}, Err: custom},
+	}}
+	AssertErrorIs(t, f.PutObject(context.Background(), "a/1", nil, strings.NewReader("x")), ErrInjectedFault)
+	AssertEqual(t, f.PutObject(context.Background(), "a/1", nil, strings.NewReader("x")), nil)
+	AssertEqual(t, f.PutObject(context.Background(), "b/1", nil, strings.NewReader("x")), nil)
+	_, _, err := f.HeadObject(context.Background(), "a/1")
+	AssertErrorIs(t, err, custom)
+	AssertEqual(t, f.Rules[0].Fired(), 1)
+	AssertEqual(t, f.Rules[1].Fired(), 1)
+}
+
+func TestFaultyS3_slow_down(t *testing.T) {
+	f := &FaultyS3{S3: &InMemoryS3{}, Rules: []*FaultRule{{Kind: FaultSlowDown}}}
+	_, _, _, err := f.ListObjects(context.Background(), "", "")
+	AssertErrorIs(t, err, ErrSlowDown)
+	AssertErrorIs(t, err, ErrInjectedFault)
+}
+
+func TestFaultyS3_latency(t *testing.T) {
+	f := &FaultyS3{S3: &InMemoryS3{}, Rules: []*FaultRule{{Kind: FaultLatency, Latency: time.Hour}}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	AssertErrorIs(t, f.DeleteObject(ctx, "thing"), context.DeadlineExceeded)
+
+	f.Rules[0].Latency = time.Millisecond
+	start := time.Now()
+	AssertEqual(t, f.DeleteObject(context.Background(), "thing"), nil)
+	AssertEqual(t, time.Since(start) >= time.Millisecond, true)
+}
+
+func TestFaultyS3_partial_write(t *testing.T) {
+	inner := &InMemoryS3{}
+	f := &FaultyS3{S3: inner, Rules: []*FaultRule{{Kind: FaultPartialWrite, Times: 1}}}
+	AssertErrorIs(t, f.PutObject(context.Background(), "thing", nil, strings.NewReader("abcdef")), ErrInjectedFault)
+	buff := new(bytes.Buffer)
+	_, err := inner.GetObject(context.Background(), "thing", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "abc")
+}
+
+func TestFaultyS3_dropped_put(t *testing.T) {
+	inner := &InMemoryS3{}
+	f := &FaultyS3{S3: inner, Rules: []*FaultRule{{Kind: FaultDroppedPut, Times: 1}}}
+	AssertErrorIs(t, f.PutObject(context.Background(), "thing", nil, strings.NewReader("abcdef")), ErrInjectedFault)
+	buff := new(bytes.Buffer)
+	_, err := inner.GetObject(context.Background(), "thing", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "abcdef")
+}
+
+func TestFaultyS3_truncated_read(t *testing.T) {
+	inner := &InMemoryS3{}
+	AssertEqual(t, inner.PutObject(context.Background(), "thing", nil, strings.NewReader("abcdef")), nil)
+	f := &FaultyS3{S3: inner, Rules: []*FaultRule{{Kind: FaultTruncatedRead, Times: 1}}}
+	buff := new(bytes.Buffer)
+	_, err := f.GetObject(context.Background(), "thing", buff)
+	AssertErrorIs(t, err, io.ErrUnexpectedEOF)
+	AssertEqual(t, buff.String(), "abc")
+
+	buff.Reset()
+	_, err = f.GetObject(context.Background(), "thing", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "abcdef")
+}
+
+func TestFaultyS3_seeded(t *testing.T) {
+	run := func(seed uint64) []bool {
+		f := &FaultyS3{S3: &InMemoryS3{}, Seed: seed, Rules: []*FaultRule{{Kind: FaultError, Probability: 0.5}}}
+		out := make([]bool, 50)
+		for i := range out {
+			out[i] = f.DeleteObject(context.Background(), "thing") != nil
+		}
+		return out
+	}
+	a, b := run(42), run(42)
+	AssertEqual(t, a, b)
+	var fired int
+	for _, v := range a {
+		if v {
+			fired++
+		}
+	}
+	AssertEqual(t, fired > 0 && fired < len(a), true)
+}
@@ -0,0 +1,287 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrorClass is a coarse classification of an operation's outcome suitable for a metric label.
+type ErrorClass string
+
+const (
+	ErrorClassNone             ErrorClass = ""
+	ErrorClassNotFound         ErrorClass = "not_found"
+	ErrorClassSlowDown         ErrorClass = "slow_down"
+	ErrorClassPermissionDenied ErrorClass = "permission_denied"
+	ErrorClassCanceled         ErrorClass = "canceled"
+	ErrorClassTimeout          ErrorClass = "timeout"
+	ErrorClassClient           ErrorClass = "client"
+	ErrorClassServer           ErrorClass = "server"
+	ErrorClassOther            ErrorClass = "other"
+)
+
+// ClassifyError returns the ErrorClass of an error returned by an S3 operation.
+func ClassifyError(err error) ErrorClass {
+	switch {
+	case err == nil:
+		return ErrorClassNone
+	case errors.Is(err, ErrObjectNotFound):
+		return ErrorClassNotFound
+	case errors.Is(err, ErrSlowDown):
+		return ErrorClassSlowDown
+	case errors.Is(err, ErrPermissionDenied):
+		return ErrorClassPermissionDenied
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout
+	default:
+		return ErrorClassOther
+	}
+}
+
+// classifyStatus returns the ErrorClass of an HTTP response status code.
+func classifyStatus(code int) ErrorClass {
+	switch {
+	case code < 400:
+		return ErrorClassNone
+	case code == http.StatusNotFound:
+		return ErrorClassNotFound
+	case code == http.StatusForbidden:
+		return ErrorClassPermissionDenied
+	case code == http.StatusServiceUnavailable || code == http.StatusTooManyRequests:
+		return ErrorClassSlowDown
+	case code < 500:
+		return ErrorClassClient
+	default:
+		return ErrorClassServer
+	}
+}
+
+// RequestObservation is the measurement of a single completed operation or HTTP request.
+type RequestObservation struct {
+	// Operation is the S3Operation or, for HTTP requests, the method.
+	Operation  string
+	Duration   time.Duration
+	BytesIn    int64
+	BytesOut   int64
+	ErrorClass ErrorClass
+}
+
+// Metrics receives observations from InstrumentedS3 and InstrumentedHttpDoer. It must be safe for concurrent use.
+type Metrics interface {
+	Observe(o RequestObservation)
+}
+
+// SpanHook is called when an operation starts. It returns the context to run the operation with and a function that
+// is called with the outcome when the operation ends, allowing tracing spans to be created around each operation.
+type SpanHook func(ctx context.Context, operation, key string) (context.Context, func(err error))
+
+type countingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.R.Read(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// InstrumentedS3 reports every operation on the underlying S3 to Metrics and the optional StartSpan hook.
+type InstrumentedS3 struct {
+	S3
+	Metrics   Metrics
+	StartSpan SpanHook
+}
+
+// instrument starts an operation and returns its context and a function to be called with its outcome.
+func (s *InstrumentedS3) instrument(ctx context.Context, op S3Operation, key string) (context.Context, func(bytesIn, bytesOut int64, err error)) {
+	start := time.Now()
+	var endSpan func(err error)
+	if s.StartSpan != nil {
+		ctx, endSpan = s.StartSpan(ctx, string(op), key)
+	}
+	return ctx, func(bytesIn, bytesOut int64, err error) {
+		if s.Metrics != nil {
+			s.Metrics.Observe(RequestObservation{
+				Operation: string(op), Duration: time.Since(start), BytesIn: bytesIn, BytesOut: bytesOut, ErrorClass: ClassifyError(err),
+			})
+		}
+		if endSpan != nil {
+			endSpan(err)
+		}
+	}
+}
+
+func (s *InstrumentedS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
+	ctx, done := s.instrument(ctx, OpGetObject, key)
+	cw := &countingWriter{W: dst}
+	meta, err = s.S3.GetObject(ctx, key, cw)
+	done(cw.N, 0, err)
+	return meta, err
+}
+
+func (s *InstrumentedS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
+	ctx, done := s.instrument(ctx, OpHeadObject, key)
+	size, meta, err = s.S3.HeadObject(ctx, key)
+	done(0, 0, err)
+	return size, meta, err
+}
+
+func (s *InstrumentedS3) ListObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	ctx, done := s.instrument(ctx, OpListObjects, prefix)
+	keys, sizes, prefixes, err = s.S3.ListObjects(ctx, prefix, delimiter)
+	done(0, 0, err)
+	return keys, sizes, prefixes, err
+}
+
+func (s *InstrumentedS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	ctx, done := s.instrument(ctx, OpPutObject, key)
+	cr := &countingReader{R: body}
+	err = s.S3.PutObject(ctx, key, meta, cr)
+	done(0, cr.N, err)
+	return err
+}
+
+func (s *InstrumentedS3) DeleteObject(ctx context.Context, key string) error {
+	ctx, done := s.instrument(ctx, OpDeleteObject, key)
+	err := s.S3.DeleteObject(ctx, key)
+	done(0, 0, err)
+	return err
+}
+
+var _ S3 = (*InstrumentedS3)(nil)
+
+// InstrumentedHttpDoer reports every request made through the underlying HttpDoer to Metrics and the optional
+// StartSpan hook, for use as the client of S3Impl. A request is complete, and observed, when its response body is
+// closed so that the duration and bytes in include reading the body.
+type InstrumentedHttpDoer struct {
+	HttpDoer
+	Metrics   Metrics
+	StartSpan SpanHook
+}
+
+type instrumentedBody struct {
+	countingReader
+	closer io.Closer
+	once   sync.Once
+	done   func(bytesIn int64)
+}
+
+func (b *instrumentedBody) Close() error {
+	err := b.closer.Close()
+	b.once.Do(func() {
+		b.done(b.N)
+	})
+	return err
+}
+
+func (d *InstrumentedHttpDoer) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	var endSpan func(err error)
+	if d.StartSpan != nil {
+		var ctx context.Context
+		ctx, endSpan = d.StartSpan(req.Context(), req.Method, req.URL.Path)
+		req = req.WithContext(ctx)
+	}
+	bytesOut := max(0, req.ContentLength)
+	observe := func(bytesIn int64, class ErrorClass, err error) {
+		if d.Metrics != nil {
+			d.Metrics.Observe(RequestObservation{
+				Operation: req.Method, Duration: time.Since(start), BytesIn: bytesIn, BytesOut: bytesOut, ErrorClass: class,
+			})
+		}
+		if endSpan != nil {
+			endSpan(err)
+		}
+	}
+
+	resp, err := d.HttpDoer.Do(req)
+	if err != nil {
+		observe(0, ClassifyError(err), err)
+		return resp, err
+	}
+	class := classifyStatus(resp.StatusCode)
+	var statusErr error
+	if class != ErrorClassNone {
+		statusErr = errors.New(resp.Status)
+	}
+	resp.Body = &instrumentedBody{countingReader: countingReader{R: resp.Body}, closer: resp.Body, done: func(bytesIn int64) {
+		observe(bytesIn, class, statusErr)
+	}}
+	return resp, nil
+}
+
+var _ HttpDoer = (*InstrumentedHttpDoer)(nil)
+
+// DefaultLatencyBuckets are the upper bounds of the latency histogram kept by MetricsRecorder.
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+// OperationStats are the aggregated observations of one operation.
+type OperationStats struct {
+	Count    int64
+	BytesIn  int64
+	BytesOut int64
+	Errors   map[ErrorClass]int64
+	// Latency counts the observations per bucket of DefaultLatencyBuckets with a final bucket for slower ones.
+	Latency []int64
+}
+
+// MetricsRecorder is an in-memory Metrics implementation that aggregates observations per operation.
+type MetricsRecorder struct {
+	mux   sync.Mutex
+	stats map[string]*OperationStats
+}
+
+func (r *MetricsRecorder) Observe(o RequestObservation) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.stats == nil {
+		r.stats = make(map[string]*OperationStats)
+	}
+	s, ok := r.stats[o.Operation]
+	if !ok {
+		s = &OperationStats{Errors: make(map[ErrorClass]int64), Latency: make([]int64, len(DefaultLatencyBuckets)+1)}
+		r.stats[o.Operation] = s
+	}
+	s.Count++
+	s.BytesIn += o.BytesIn
+	s.BytesOut += o.BytesOut
+	if o.ErrorClass != ErrorClassNone {
+		s.Errors[o.ErrorClass]++
+	}
+	bucket := len(DefaultLatencyBuckets)
+	for i, upper := range DefaultLatencyBuckets {
+		if o.Duration <= upper {
+			bucket = i
+			break
+		}
+	}
+	s.Latency[bucket]++
+}
+
+// Stats returns a copy of the aggregated observations of the operation.
+func (r *MetricsRecorder) Stats(operation string) OperationStats {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if s, ok := r.stats[operation]; !ok {
+		return OperationStats{Errors: map[ErrorClass]int64{}, Latency: make([]int64, len(DefaultLatencyBuckets)+1)}
+	} else {
+		out := *s
+		out.Errors = maps.Clone(s.Errors)
+		out.Latency = slices.Clone(s.Latency)
+		return out
+	}
+}
+
+var _ Metrics = (*MetricsRecorder)(nil)
@@ -0,0 +1,94 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestInstrumentedS3(t *testing.T) {
+	recorder := new(MetricsRecorder)
+	testS3Interface(t, &InstrumentedS3{S3: &InMemoryS3{}, Metrics: recorder})
+	AssertEqual(t, recorder.Stats(string(OpPutObject)).Count, int64(6))
+	AssertEqual(t, recorder.Stats(string(OpPutObject)).BytesOut, int64(1+2+3+4+5+7))
+}
+
+func TestInstrumentedS3_observations(t *testing.T) {
+	recorder := new(MetricsRecorder)
+	var spans []string
+	s := &InstrumentedS3{S3: &InMemoryS3{}, Metrics: recorder, StartSpan: func(ctx context.Context, operation, key string) (context.Context, func(err error)) {
+		return ctx, func(err error) {
+			spans = append(spans, operation+" "+key+" "+string(ClassifyError(err)))
+		}
+	}}
+	AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("hello")), nil)
+	_, err := s.GetObject(context.Background(), "a", io.Discard)
+	AssertEqual(t, err, nil)
+	_, err = s.GetObject(context.Background(), "b", io.Discard)
+	AssertErrorIs(t, err, ErrObjectNotFound)
+
+	stats := recorder.Stats(string(OpGetObject))
+	AssertEqual(t, stats.Count, int64(2))
+	AssertEqual(t, stats.BytesIn, int64(5))
+	AssertEqual(t, stats.Errors, map[ErrorClass]int64{ErrorClassNotFound: 1})
+	var observed int64
+	for _, n := range stats.Latency {
+		observed += n
+	}
+	AssertEqual(t, observed, int64(2))
+	AssertEqual(t, spans, []string{"PutObject a ", "GetObject a ", "GetObject b not_found"})
+	AssertEqual(t, recorder.Stats(string(OpDeleteObject)).Count, int64(0))
+}
+
+func TestClassifyError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	AssertEqual(t, ClassifyError(ctx.Err()), ErrorClassCanceled)
+	AssertEqual(t, ClassifyError(&PermissionError{Op: OpPutObject}), ErrorClassPermissionDenied)
+	AssertEqual(t, ClassifyError(ErrInjectedFault), ErrorClassOther)
+}
+
+func TestInstrumentedHttpDoer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/a":
+			_, _ = w.Write([]byte("hello"))
+		case "/bucket/busy":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	recorder := new(MetricsRecorder)
+	var spans []string
+	doer := &InstrumentedHttpDoer{HttpDoer: srv.Client(), Metrics: recorder, StartSpan: func(ctx context.Context, operation, key string) (context.Context, func(err error)) {
+		return ctx, func(err error) {
+			spans = append(spans, operation+" "+key)
+		}
+	}}
+	u, _ := url.Parse(srv.URL + "/bucket/")
+	s := NewS3Impl(doer, u)
+
+	buff := new(bytes.Buffer)
+	_, err := s.GetObject(context.Background(), "a", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "hello")
+	_, _, err = s.HeadObject(context.Background(), "missing")
+	AssertErrorIs(t, err, ErrObjectNotFound)
+	_, err = s.GetObject(context.Background(), "busy", io.Discard)
+	AssertErrorIs(t, err, ErrSlowDown)
+
+	get := recorder.Stats(http.MethodGet)
+	AssertEqual(t, get.Count, int64(2))
+	AssertEqual(t, get.BytesIn, int64(5))
+	AssertEqual(t, get.Errors, map[ErrorClass]int64{ErrorClassSlowDown: 1})
+	AssertEqual(t, recorder.Stats(http.MethodHead).Errors, map[ErrorClass]int64{ErrorClassNotFound: 1})
+	AssertEqual(t, spans, []string{"GET /bucket/a", "HEAD /bucket/missing", "GET /bucket/busy"})
+}
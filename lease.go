@@ -0,0 +1,166 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLeaseHeld is returned when acquiring a lease that another owner holds and hasn't let expire.
+	ErrLeaseHeld = errors.New("lease is held by another owner")
+	// ErrLeaseLost is returned when renewing or releasing a lease that has been taken over since it was acquired.
+	ErrLeaseLost = errors.New("lease was lost")
+)
+
+// LeaseKey returns the key of the lease object with the given name for a document, e.g. "compaction".
+func LeaseKey(documentId, name string) string {
+	return DocumentPrefix(documentId) + "leases/" + name
+}
+
+// leaseRecord is the content of a lease object.
+type leaseRecord struct {
+	Owner   string `json:"owner"`
+	Expires int64  `json:"expires_unix_ms"`
+	Token   uint64 `json:"token"`
+}
+
+// Lease is a time-limited lock held in an object in the S3, which must implement ConditionalPutter and ETagGetter.
+// The lease object is created with a create-if-not-exists write and every later change is a compare-and-swap on its
+// ETag, so only one owner can hold the lease at a time. A lease that has expired can be taken over by anyone.
+//
+// Each acquisition increments the fencing token, which holders should pass along with the writes they make under the
+// lease so that writes from a holder that has lost the lease without noticing can be rejected. Expiry is judged by
+// the clock of each client, so TTL should be much longer than the expected clock skew.
+type Lease struct {
+	S3    S3
+	Key   string
+	Owner string
+	TTL   time.Duration
+	// Clock is used to set and check the expiry. Defaults to time.Now.
+	Clock func() time.Time
+
+	mux    sync.Mutex
+	etag   string
+	record leaseRecord
+}
+
+func (l *Lease) now() time.Time {
+	if l.Clock != nil {
+		return l.Clock()
+	}
+	return time.Now()
+}
+
+func (l *Lease) stores() (ConditionalPutter, ETagGetter, error) {
+	putter, ok := l.S3.(ConditionalPutter)
+	if !ok {
+		return nil, nil, errors.New("leases require a store that supports conditional writes")
+	}
+	getter, ok := l.S3.(ETagGetter)
+	if !ok {
+		return nil, nil, errors.New("leases require a store that returns etags")
+	}
+	return putter, getter, nil
+}
+
+// write stores the record on the condition and remembers it as held.
+func (l *Lease) write(ctx context.Context, putter ConditionalPutter, record leaseRecord, cond PutCondition) error {
+	raw, err := json.Marshal(&record)
+	if err != nil {
+		return fmt.Errorf("failed to encode lease: %w", err)
+	}
+	etag, err := putter.PutObjectIf(ctx, l.Key, nil, bytes.NewReader(raw), cond)
+	if err != nil {
+		return err
+	} else if etag == "" {
+		return errors.New("store returned no etag for the lease")
+	}
+	l.etag, l.record = etag, record
+	return nil
+}
+
+// Acquire takes the lease if it is free, expired or already held by this owner, and returns the new fencing token.
+func (l *Lease) Acquire(ctx context.Context) (token uint64, err error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	putter, getter, err := l.stores()
+	if err != nil {
+		return 0, err
+	}
+
+	buff := new(bytes.Buffer)
+	current := new(leaseRecord)
+	cond := PutCondition{IfNoneMatch: true}
+	if etag, _, err := getter.GetObjectETag(ctx, l.Key, buff); errors.Is(err, ErrObjectNotFound) {
+		// create the lease
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read lease: %w", err)
+	} else if etag == "" {
+		return 0, errors.New("failed to read lease: store returned no etag")
+	} else if err := json.Unmarshal(buff.Bytes(), current); err != nil {
+		return 0, fmt.Errorf("failed to decode lease: %w", err)
+	} else if current.Owner != l.Owner && l.now().UnixMilli() < current.Expires {
+		return 0, fmt.Errorf("%w: '%s' until %s", ErrLeaseHeld, current.Owner, time.UnixMilli(current.Expires).UTC().Format(time.RFC3339))
+	} else {
+		cond = PutCondition{IfMatch: etag}
+	}
+
+	record := leaseRecord{Owner: l.Owner, Expires: l.now().Add(l.TTL).UnixMilli(), Token: current.Token + 1}
+	if err := l.write(ctx, putter, record, cond); errors.Is(err, ErrPreconditionFailed) {
+		return 0, fmt.Errorf("%w: lost the race to acquire it", ErrLeaseHeld)
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to write lease: %w", err)
+	}
+	return record.Token, nil
+}
+
+// Token returns the fencing token of the held lease, or 0 if it isn't held.
+func (l *Lease) Token() uint64 {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.record.Token
+}
+
+// Renew extends the expiry of the held lease by TTL, keeping the fencing token. It returns ErrLeaseLost if the lease
+// was taken over, which can only happen after it expired.
+func (l *Lease) Renew(ctx context.Context) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.update(ctx, l.now().Add(l.TTL))
+}
+
+// Release gives up the held lease by marking it as expired. The object is kept so that the fencing token keeps
+// increasing for the next owner.
+func (l *Lease) Release(ctx context.Context) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if err := l.update(ctx, time.UnixMilli(0)); err != nil {
+		return err
+	}
+	l.etag, l.record = "", leaseRecord{}
+	return nil
+}
+
+// update swaps the held lease record for one with the given expiry.
+func (l *Lease) update(ctx context.Context, expires time.Time) error {
+	putter, _, err := l.stores()
+	if err != nil {
+		return err
+	} else if l.etag == "" {
+		return fmt.Errorf("%w: lease is not held", ErrLeaseLost)
+	}
+	record := l.record
+	record.Expires = expires.UnixMilli()
+	if err := l.write(ctx, putter, record, PutCondition{IfMatch: l.etag}); errors.Is(err, ErrPreconditionFailed) {
+		l.etag, l.record = "", leaseRecord{}
+		return fmt.Errorf("%w: %w", ErrLeaseLost, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to write lease: %w", err)
+	}
+	return nil
+}
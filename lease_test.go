@@ -0,0 +1,131 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for lease tests.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestInMemoryS3_conditional_put(t *testing.T) {
+	s := &InMemoryS3{}
+	etag, err := s.PutObjectIf(context.Background(), "a", nil, strings.NewReader("one"), PutCondition{IfNoneMatch: true})
+	AssertEqual(t, err, nil)
+	_, err = s.PutObjectIf(context.Background(), "a", nil, strings.NewReader("two"), PutCondition{IfNoneMatch: true})
+	AssertErrorIs(t, err, ErrPreconditionFailed)
+	_, err = s.PutObjectIf(context.Background(), "a", nil, strings.NewReader("two"), PutCondition{IfMatch: `"other"`})
+	AssertErrorIs(t, err, ErrPreconditionFailed)
+	_, err = s.PutObjectIf(context.Background(), "b", nil, strings.NewReader("two"), PutCondition{IfMatch: etag})
+	AssertErrorIs(t, err, ErrPreconditionFailed)
+	next, err := s.PutObjectIf(context.Background(), "a", nil, strings.NewReader("two"), PutCondition{IfMatch: etag})
+	AssertEqual(t, err, nil)
+	_, current, _, err := s.HeadObjectETag(context.Background(), "a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, current, next)
+}
+
+func TestLease(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	inner := &InMemoryS3{}
+	key := LeaseKey("doc-1", "compaction")
+	a := &Lease{S3: inner, Key: key, Owner: "peer-a", TTL: time.Minute, Clock: clock.Now}
+	b := &Lease{S3: inner, Key: key, Owner: "peer-b", TTL: time.Minute, Clock: clock.Now}
+
+	token, err := a.Acquire(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, token, uint64(1))
+	_, err = b.Acquire(context.Background())
+	AssertErrorIs(t, err, ErrLeaseHeld)
+	AssertErrorEqual(t, err, "lease is held by another owner: 'peer-a' until 2023-11-14T22:14:20Z")
+
+	// renewing keeps the lease past the original expiry
+	clock.Advance(50 * time.Second)
+	AssertEqual(t, a.Renew(context.Background()), nil)
+	clock.Advance(50 * time.Second)
+	_, err = b.Acquire(context.Background())
+	AssertErrorIs(t, err, ErrLeaseHeld)
+
+	// an expired lease is taken over with a higher fencing token
+	clock.Advance(time.Minute)
+	token, err = b.Acquire(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, token, uint64(2))
+	AssertErrorIs(t, a.Renew(context.Background()), ErrLeaseLost)
+	AssertEqual(t, a.Token(), uint64(0))
+	AssertErrorIs(t, a.Release(context.Background()), ErrLeaseLost)
+
+	// releasing lets the next owner in immediately
+	AssertEqual(t, b.Release(context.Background()), nil)
+	token, err = a.Acquire(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, token, uint64(3))
+}
+
+// interleavingS3 runs a function after the next GetObjectETag has read the object, to simulate a concurrent writer.
+type interleavingS3 struct {
+	*InMemoryS3
+	after func()
+}
+
+func (s *interleavingS3) GetObjectETag(ctx context.Context, key string, dst io.Writer) (string, map[string]string, error) {
+	etag, meta, err := s.InMemoryS3.GetObjectETag(ctx, key, dst)
+	if s.after != nil {
+		after := s.after
+		s.after = nil
+		after()
+	}
+	return etag, meta, err
+}
+
+func TestLease_race(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	inner := &InMemoryS3{}
+	a := &Lease{S3: inner, Key: "lease", Owner: "peer-a", TTL: time.Minute, Clock: clock.Now}
+	_, err := a.Acquire(context.Background())
+	AssertEqual(t, err, nil)
+	clock.Advance(2 * time.Minute)
+
+	// both peers see the expired lease but only the first swap wins
+	b := &Lease{S3: inner, Key: "lease", Owner: "peer-b", TTL: time.Minute, Clock: clock.Now}
+	c := &Lease{S3: &interleavingS3{InMemoryS3: inner, after: func() {
+		_, err := b.Acquire(context.Background())
+		AssertEqual(t, err, nil)
+	}}, Key: "lease", Owner: "peer-c", TTL: time.Minute, Clock: clock.Now}
+	_, err = c.Acquire(context.Background())
+	AssertErrorIs(t, err, ErrLeaseHeld)
+	AssertErrorEqual(t, err, "lease is held by another owner: lost the race to acquire it")
+	AssertEqual(t, b.Token(), uint64(2))
+}
+
+func TestLease_unsupported_store(t *testing.T) {
+	l := &Lease{S3: &PolicyS3{S3: &InMemoryS3{}}, Key: "lease", Owner: "peer-a", TTL: time.Minute}
+	_, err := l.Acquire(context.Background())
+	AssertErrorEqual(t, err, "leases require a store that supports conditional writes")
+}
+
+func TestLease_missing_etag(t *testing.T) {
+	inner := &InMemoryS3{}
+	a := &Lease{S3: inner, Key: "lease", Owner: "peer-a", TTL: time.Minute}
+	_, err := a.Acquire(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, a.Release(context.Background()), nil)
+
+	b := &Lease{S3: &noETagS3{InMemoryS3: inner}, Key: "lease", Owner: "peer-b", TTL: time.Minute}
+	_, err = b.Acquire(context.Background())
+	AssertErrorEqual(t, err, "failed to read lease: store returned no etag")
+	AssertEqual(t, b.Token(), uint64(0))
+}
@@ -0,0 +1,127 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// maxManifestAttempts bounds how many times UpdateManifest retries when other writers keep updating the manifest.
+const maxManifestAttempts = 8
+
+// ManifestKey returns the key of the manifest object of a document.
+func ManifestKey(documentId string) string {
+	return DocumentPrefix(documentId) + "manifest"
+}
+
+// Manifest is a small summary of a document's state, kept next to its change log so that readers can find out
+// exactly which change objects they need with a single GET instead of listing the change prefixes. Writers must
+// update it after their change objects are written, so every change it refers to can be downloaded.
+//
+// Snapshot is the key of a snapshot that contains the changes up to SnapshotCovers, so a reader starting from scratch
+// can load it and then only read the changes after those marks.
+type Manifest struct {
+	Heads          []string          `json:"heads"`
+	Snapshot       string            `json:"snapshot,omitempty"`
+	SnapshotCovers map[string]uint64 `json:"snapshot_covers,omitempty"`
+	// Peers maps each peer to the last sequence number of its change log.
+	Peers map[string]uint64 `json:"peers"`
+}
+
+// Advance raises the high-water mark of the peer to seq. Marks never go backwards.
+func (m *Manifest) Advance(peer string, seq uint64) {
+	if m.Peers == nil {
+		m.Peers = make(map[string]uint64)
+	}
+	m.Peers[peer] = max(m.Peers[peer], seq)
+}
+
+// Missing returns the changes of the document that come after the sequence numbers in seen, ordered by peer and
+// sequence number. The refs have no Size since the changes aren't listed.
+func (m *Manifest) Missing(documentId string, seen map[string]uint64) []ChangeRef {
+	peers := make([]string, 0, len(m.Peers))
+	for peer := range m.Peers {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	var refs []ChangeRef
+	for _, peer := range peers {
+		for seq := seen[peer] + 1; seq <= m.Peers[peer]; seq++ {
+			refs = append(refs, ChangeRef{Peer: peer, Seq: seq, Key: ChangeKey(documentId, peer, seq)})
+		}
+	}
+	return refs
+}
+
+func manifestStores(s3 S3) (ConditionalPutter, ETagGetter, error) {
+	putter, ok := s3.(ConditionalPutter)
+	if !ok {
+		return nil, nil, errors.New("manifests require a store that supports conditional writes")
+	}
+	getter, ok := s3.(ETagGetter)
+	if !ok {
+		return nil, nil, errors.New("manifests require a store that returns etags")
+	}
+	return putter, getter, nil
+}
+
+// ReadManifest returns the manifest of the document and its ETag, or ErrObjectNotFound if it has none yet. The S3
+// must implement ETagGetter.
+func ReadManifest(ctx context.Context, s3 S3, documentId string) (*Manifest, string, error) {
+	if err := validateKeySegment("document", documentId); err != nil {
+		return nil, "", err
+	}
+	getter, ok := s3.(ETagGetter)
+	if !ok {
+		return nil, "", errors.New("manifests require a store that returns etags")
+	}
+	buff := new(bytes.Buffer)
+	etag, _, err := getter.GetObjectETag(ctx, ManifestKey(documentId), buff)
+	if err != nil {
+		return nil, "", err
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(buff.Bytes(), m); err != nil {
+		return nil, "", fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return m, etag, nil
+}
+
+// UpdateManifest applies the update to the latest manifest of the document and writes it back if the manifest
+// hasn't changed in the meantime, starting from an empty manifest if there is none. When another writer gets there
+// first, the update is applied again to their manifest, so it must be safe to repeat. The S3 must implement
+// ConditionalPutter and ETagGetter.
+func UpdateManifest(ctx context.Context, s3 S3, documentId string, update func(m *Manifest) error) (*Manifest, error) {
+	putter, _, err := manifestStores(s3)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < maxManifestAttempts; attempt++ {
+		m, etag, err := ReadManifest(ctx, s3, documentId)
+		cond := PutCondition{IfMatch: etag}
+		if errors.Is(err, ErrObjectNotFound) {
+			m, cond = new(Manifest), PutCondition{IfNoneMatch: true}
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %w", err)
+		} else if etag == "" {
+			// an empty IfMatch would make the write unconditional and could overwrite a concurrent update
+			return nil, errors.New("failed to read manifest: store returned no etag")
+		}
+		if err := update(m); err != nil {
+			return nil, err
+		}
+		raw, err := json.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode manifest: %w", err)
+		}
+		if _, err := putter.PutObjectIf(ctx, ManifestKey(documentId), nil, bytes.NewReader(raw), cond); err == nil {
+			return m, nil
+		} else if !errors.Is(err, ErrPreconditionFailed) {
+			return nil, fmt.Errorf("failed to write manifest: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("failed to update manifest after %d attempts: %w", maxManifestAttempts, ErrPreconditionFailed)
+}
@@ -0,0 +1,99 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestManifest_Missing(t *testing.T) {
+	m := &Manifest{}
+	m.Advance("peer-b", 2)
+	m.Advance("peer-a", 3)
+	m.Advance("peer-a", 1)
+	AssertEqual(t, m.Peers, map[string]uint64{"peer-a": 3, "peer-b": 2})
+	AssertEqual(t, m.Missing("doc-1", map[string]uint64{"peer-a": 1, "peer-b": 2}), []ChangeRef{
+		{Peer: "peer-a", Seq: 2, Key: ChangeKey("doc-1", "peer-a", 2)},
+		{Peer: "peer-a", Seq: 3, Key: ChangeKey("doc-1", "peer-a", 3)},
+	})
+	AssertEqual(t, len(m.Missing("doc-1", nil)), 5)
+}
+
+func TestUpdateManifest(t *testing.T) {
+	s := &InMemoryS3{}
+	_, _, err := ReadManifest(context.Background(), s, "doc-1")
+	AssertErrorIs(t, err, ErrObjectNotFound)
+
+	m, err := UpdateManifest(context.Background(), s, "doc-1", func(m *Manifest) error {
+		m.Advance("peer-a", 1)
+		m.Heads = []string{"h1"}
+		return nil
+	})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, m.Peers, map[string]uint64{"peer-a": 1})
+
+	m, err = UpdateManifest(context.Background(), s, "doc-1", func(m *Manifest) error {
+		m.Snapshot, m.SnapshotCovers = "docs/doc-1/snapshot", map[string]uint64{"peer-a": 1}
+		return nil
+	})
+	AssertEqual(t, err, nil)
+	read, _, err := ReadManifest(context.Background(), s, "doc-1")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, read, m)
+	AssertEqual(t, read.Heads, []string{"h1"})
+}
+
+func TestUpdateManifest_race(t *testing.T) {
+	inner := &InMemoryS3{}
+	var attempts int
+	s := &interleavingS3{InMemoryS3: inner, after: func() {
+		_, err := UpdateManifest(context.Background(), inner, "doc-1", func(m *Manifest) error {
+			m.Advance("peer-b", 1)
+			return nil
+		})
+		AssertEqual(t, err, nil)
+	}}
+	// the first attempt loses to peer-b and the update is applied again on top of theirs
+	m, err := UpdateManifest(context.Background(), s, "doc-1", func(m *Manifest) error {
+		attempts++
+		m.Advance("peer-a", 1)
+		return nil
+	})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, attempts, 2)
+	AssertEqual(t, m.Peers, map[string]uint64{"peer-a": 1, "peer-b": 1})
+}
+
+func TestUpdateManifest_unsupported_store(t *testing.T) {
+	_, err := UpdateManifest(context.Background(), &PrefixedS3{S3: &InMemoryS3{}, Prefix: "x/"}, "doc-1", func(m *Manifest) error {
+		return nil
+	})
+	AssertErrorEqual(t, err, "manifests require a store that supports conditional writes")
+}
+
+// noETagS3 is a store that reads objects without their etag.
+type noETagS3 struct {
+	*InMemoryS3
+}
+
+func (s *noETagS3) GetObjectETag(ctx context.Context, key string, dst io.Writer) (string, map[string]string, error) {
+	_, meta, err := s.InMemoryS3.GetObjectETag(ctx, key, dst)
+	return "", meta, err
+}
+
+func TestUpdateManifest_missing_etag(t *testing.T) {
+	inner := &InMemoryS3{}
+	_, err := UpdateManifest(context.Background(), inner, "doc-1", func(m *Manifest) error {
+		m.Advance("peer-a", 1)
+		return nil
+	})
+	AssertEqual(t, err, nil)
+	_, err = UpdateManifest(context.Background(), &noETagS3{InMemoryS3: inner}, "doc-1", func(m *Manifest) error {
+		m.Advance("peer-b", 1)
+		return nil
+	})
+	AssertErrorEqual(t, err, "failed to read manifest: store returned no etag")
+	m, _, err := ReadManifest(context.Background(), inner, "doc-1")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, m.Peers, map[string]uint64{"peer-a": 1})
+}
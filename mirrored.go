@@ -0,0 +1,283 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"sync"
+	"time"
+)
+
+// MirroredS3 replicates writes and deletes to the embedded primary S3 and each of the Secondaries. Reads are served
+// by the primary and fall back to the secondaries in order when it fails for any reason other than the object not
+// existing.
+//
+// Secondary writes are applied inline unless Async is set, in which case they are added to a durable queue in
+// QueueDir and applied by Replay, so Async requires a QueueDir and writes are rejected before reaching the primary
+// without one. When a QueueDir is configured, failed inline secondary writes are queued too rather
+// than failing the operation. Queued items only record the key, and replaying one copies the current state of the key
+// from the primary, so replays are idempotent and always converge on the primary.
+type MirroredS3 struct {
+	S3
+	Secondaries []S3
+	Async       bool
+	QueueDir    string
+
+	queueOnce sync.Once
+	queue     dirQueue
+}
+
+type mirrorQueueItem struct {
+	Secondary int    `json:"secondary"`
+	Key       string `json:"key"`
+}
+
+func (m *MirroredS3) getQueue() (*dirQueue, error) {
+	if m.QueueDir == "" {
+		return nil, errors.New("mirror queue is not configured")
+	}
+	m.queueOnce.Do(func() {
+		m.queue.dir = m.QueueDir
+	})
+	return &m.queue, nil
+}
+
+// countingWriter records whether anything has been written so that reads are only retried on another backend when
+// the destination is still untouched.
+type countingWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.W.Write(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// shouldFallback returns whether a read error from one backend should be retried on the next.
+func shouldFallback(ctx context.Context, err error) bool {
+	return err != nil && !errors.Is(err, ErrObjectNotFound) && ctx.Err() == nil
+}
+
+func (m *MirroredS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
+	cw := &countingWriter{W: dst}
+	meta, err = m.S3.GetObject(ctx, key, cw)
+	for _, secondary := range m.Secondaries {
+		if !shouldFallback(ctx, err) || cw.N > 0 {
+			break
+		}
+		meta, err = secondary.GetObject(ctx, key, cw)
+	}
+	return meta, err
+}
+
+func (m *MirroredS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
+	size, meta, err = m.S3.HeadObject(ctx, key)
+	for _, secondary := range m.Secondaries {
+		if !shouldFallback(ctx, err) {
+			break
+		}
+		size, meta, err = secondary.HeadObject(ctx, key)
+	}
+	return size, meta, err
+}
+
+func (m *MirroredS3) ListObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	keys, sizes, prefixes, err = m.S3.ListObjects(ctx, prefix, delimiter)
+	for _, secondary := range m.Secondaries {
+		if !shouldFallback(ctx, err) {
+			break
+		}
+		keys, sizes, prefixes, err = secondary.ListObjects(ctx, prefix, delimiter)
+	}
+	return keys, sizes, prefixes, err
+}
+
+// checkConfig rejects writes that couldn't be mirrored as configured, before the primary is touched.
+func (m *MirroredS3) checkConfig() error {
+	if m.Async && m.QueueDir == "" && len(m.Secondaries) > 0 {
+		return errors.New("async mirroring requires a QueueDir")
+	}
+	return nil
+}
+
+// mirror applies a write that already succeeded on the primary to the secondaries, queueing it where configured.
+func (m *MirroredS3) mirror(ctx context.Context, key string, apply func(secondary S3) error) error {
+	var errs []error
+	for i, secondary := range m.Secondaries {
+		if !m.Async {
+			err := apply(secondary)
+			if err == nil {
+				continue
+			} else if m.QueueDir == "" {
+				errs = append(errs, fmt.Errorf("failed to mirror to secondary %d: %w", i, err))
+				continue
+			}
+		}
+		if q, err := m.getQueue(); err != nil {
+			errs = append(errs, err)
+		} else if _, err := q.push(&mirrorQueueItem{Secondary: i, Key: key}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to queue mirror to secondary %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MirroredS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	if len(m.Secondaries) == 0 {
+		return m.S3.PutObject(ctx, key, meta, body)
+	}
+	if err := m.checkConfig(); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to buffer data: %w", err)
+	} else if err := m.S3.PutObject(ctx, key, meta, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	return m.mirror(ctx, key, func(secondary S3) error {
+		return secondary.PutObject(ctx, key, maps.Clone(meta), bytes.NewReader(data))
+	})
+}
+
+func (m *MirroredS3) DeleteObject(ctx context.Context, key string) error {
+	if err := m.checkConfig(); err != nil {
+		return err
+	} else if err := m.S3.DeleteObject(ctx, key); err != nil {
+		return err
+	}
+	return m.mirror(ctx, key, func(secondary S3) error {
+		return secondary.DeleteObject(ctx, key)
+	})
+}
+
+// copyFromPrimary makes the key on the secondary match the primary, deleting it if it doesn't exist on the primary.
+func (m *MirroredS3) copyFromPrimary(ctx context.Context, secondary S3, key string) error {
+	buff := new(bytes.Buffer)
+	if meta, err := m.S3.GetObject(ctx, key, buff); errors.Is(err, ErrObjectNotFound) {
+		return secondary.DeleteObject(ctx, key)
+	} else if err != nil {
+		return fmt.Errorf("failed to read from primary: %w", err)
+	} else {
+		return secondary.PutObject(ctx, key, meta, buff)
+	}
+}
+
+// Replay applies the queued secondary writes in order and returns how many were applied. It stops at the first item
+// that fails, leaving it and the rest in the queue.
+func (m *MirroredS3) Replay(ctx context.Context) (replayed int, err error) {
+	q, err := m.getQueue()
+	if err != nil {
+		return 0, err
+	}
+	names, err := q.names()
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		item := new(mirrorQueueItem)
+		if err := q.read(name, item); err != nil {
+			return replayed, err
+		} else if item.Secondary < 0 || item.Secondary >= len(m.Secondaries) {
+			return replayed, fmt.Errorf("queue item %s refers to unknown secondary %d", name, item.Secondary)
+		} else if err := m.copyFromPrimary(ctx, m.Secondaries[item.Secondary], item.Key); err != nil {
+			return replayed, fmt.Errorf("failed to replay '%s' to secondary %d: %w", item.Key, item.Secondary, err)
+		} else if err := q.remove(name); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// RunReplay calls Replay every interval until the context is cancelled. Failures are retried on the next interval.
+func (m *MirroredS3) RunReplay(ctx context.Context, interval time.Duration) error {
+	return runReplay(ctx, interval, m.Replay)
+}
+
+// differ reports whether the key differs between the primary and the secondary, by size and then by ETag if both
+// stores return them.
+func (m *MirroredS3) differ(ctx context.Context, secondary S3, key string, size, secondarySize int64) (bool, error) {
+	if size != secondarySize {
+		return true, nil
+	}
+	primaryGetter, ok := m.S3.(ETagGetter)
+	if !ok {
+		return false, nil
+	}
+	secondaryGetter, ok := secondary.(ETagGetter)
+	if !ok {
+		return false, nil
+	}
+	_, etag, _, err := primaryGetter.HeadObjectETag(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		// deleted since it was listed, copying removes it from the secondary too
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	_, secondaryEtag, _, err := secondaryGetter.HeadObjectETag(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return etag != secondaryEtag, nil
+}
+
+// Reconcile compares the objects under prefix on the primary with each secondary and repairs any drift by copying
+// objects that are missing or differ from the primary and deleting objects that only exist on the secondary. Returns
+// the number of objects repaired.
+//
+// Objects of the same size are also compared by ETag when both stores implement ETagGetter, otherwise they are assumed
+// to be equal. ETags are only comparable when both stores compute them the same way, such as the MD5 of single part
+// uploads, so stores that don't will have their objects copied again on every Reconcile.
+func (m *MirroredS3) Reconcile(ctx context.Context, prefix string) (repaired int, err error) {
+	keys, sizes, _, err := m.S3.ListObjects(ctx, prefix, "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list primary: %w", err)
+	}
+	primary := make(map[string]int64, len(keys))
+	for i, k := range keys {
+		primary[k] = sizes[i]
+	}
+	for i, secondary := range m.Secondaries {
+		secondaryKeys, secondarySizes, _, err := secondary.ListObjects(ctx, prefix, "")
+		if err != nil {
+			return repaired, fmt.Errorf("failed to list secondary %d: %w", i, err)
+		}
+		seen := make(map[string]bool, len(secondaryKeys))
+		for j, k := range secondaryKeys {
+			seen[k] = true
+			if size, ok := primary[k]; !ok {
+				if err := secondary.DeleteObject(ctx, k); err != nil {
+					return repaired, fmt.Errorf("failed to delete '%s' from secondary %d: %w", k, i, err)
+				}
+				repaired++
+			} else if differ, err := m.differ(ctx, secondary, k, size, secondarySizes[j]); err != nil {
+				return repaired, fmt.Errorf("failed to compare '%s' on secondary %d: %w", k, i, err)
+			} else if differ {
+				if err := m.copyFromPrimary(ctx, secondary, k); err != nil {
+					return repaired, fmt.Errorf("failed to repair '%s' on secondary %d: %w", k, i, err)
+				}
+				repaired++
+			}
+		}
+		for _, k := range keys {
+			if !seen[k] {
+				if err := m.copyFromPrimary(ctx, secondary, k); err != nil {
+					return repaired, fmt.Errorf("failed to repair '%s' on secondary %d: %w", k, i, err)
+				}
+				repaired++
+			}
+		}
+	}
+	return repaired, nil
+}
+
+var _ S3 = (*MirroredS3)(nil)
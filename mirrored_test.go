@@ -0,0 +1,135 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMirroredS3(t *testing.T) {
+	primary, secondary := &InMemoryS3{}, &InMemoryS3{}
+	testS3Interface(t, &MirroredS3{S3: primary, Secondaries: []S3{secondary}})
+
+	AssertEqual(t, (&MirroredS3{S3: primary, Secondaries: []S3{secondary}}).PutObject(context.Background(), "a", map[string]string{"x": "y"}, strings.NewReader("data")), nil)
+	buff := new(bytes.Buffer)
+	m, err := secondary.GetObject(context.Background(), "a", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "data")
+	AssertEqual(t, m["x"], "y")
+}
+
+func TestMirroredS3_read_fallback(t *testing.T) {
+	secondary := &InMemoryS3{}
+	primary := &FaultyS3{S3: &InMemoryS3{}}
+	s := &MirroredS3{S3: primary, Secondaries: []S3{secondary}}
+	AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("data")), nil)
+	primary.Rules = []*FaultRule{{Kind: FaultError, Ops: []S3Operation{OpGetObject, OpHeadObject, OpListObjects}}}
+
+	buff := new(bytes.Buffer)
+	_, err := s.GetObject(context.Background(), "a", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "data")
+	n, _, err := s.HeadObject(context.Background(), "a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, int64(4))
+	keys, _, _, err := s.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, keys, []string{"a"})
+
+	// partially written reads are not retried
+	primary.Rules = []*FaultRule{{Kind: FaultTruncatedRead}}
+	buff.Reset()
+	_, err = s.GetObject(context.Background(), "a", buff)
+	AssertErrorIs(t, err, ErrInjectedFault)
+	AssertEqual(t, buff.String(), "da")
+}
+
+func TestMirroredS3_async(t *testing.T) {
+	primary, secondary := &InMemoryS3{}, &InMemoryS3{}
+	dir := t.TempDir()
+	s := &MirroredS3{S3: primary, Secondaries: []S3{secondary}, Async: true, QueueDir: dir}
+	AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("one")), nil)
+	AssertEqual(t, s.PutObject(context.Background(), "b", nil, strings.NewReader("two")), nil)
+	AssertEqual(t, s.DeleteObject(context.Background(), "b"), nil)
+	keys, _, _, _ := secondary.ListObjects(context.Background(), "", "")
+	AssertEqual(t, keys, []string{})
+
+	// the queue survives a restart
+	s = &MirroredS3{S3: primary, Secondaries: []S3{secondary}, Async: true, QueueDir: dir}
+	n, err := s.Replay(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 3)
+	keys, _, _, _ = secondary.ListObjects(context.Background(), "", "")
+	AssertEqual(t, keys, []string{"a"})
+
+	n, err = s.Replay(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 0)
+}
+
+func TestMirroredS3_async_without_queue(t *testing.T) {
+	primary, secondary := &InMemoryS3{}, &InMemoryS3{}
+	AssertEqual(t, primary.PutObject(context.Background(), "b", nil, strings.NewReader("two")), nil)
+	s := &MirroredS3{S3: primary, Secondaries: []S3{secondary}, Async: true}
+	AssertErrorEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("one")), "async mirroring requires a QueueDir")
+	AssertErrorEqual(t, s.DeleteObject(context.Background(), "b"), "async mirroring requires a QueueDir")
+	// neither write reached the primary
+	keys, _, _, _ := primary.ListObjects(context.Background(), "", "")
+	AssertEqual(t, keys, []string{"b"})
+}
+
+func TestMirroredS3_failed_secondary(t *testing.T) {
+	primary := &InMemoryS3{}
+	secondary := &FaultyS3{S3: &InMemoryS3{}, Rules: []*FaultRule{{Kind: FaultError, Ops: []S3Operation{OpPutObject}, Times: 2}}}
+
+	t.Run("without queue", func(t *testing.T) {
+		s := &MirroredS3{S3: primary, Secondaries: []S3{secondary}}
+		AssertErrorIs(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("one")), ErrInjectedFault)
+		_, _, err := primary.HeadObject(context.Background(), "a")
+		AssertEqual(t, err, nil)
+	})
+
+	t.Run("with queue", func(t *testing.T) {
+		s := &MirroredS3{S3: primary, Secondaries: []S3{secondary}, QueueDir: t.TempDir()}
+		AssertEqual(t, s.PutObject(context.Background(), "b", nil, strings.NewReader("two")), nil)
+		n, err := s.Replay(context.Background())
+		AssertEqual(t, err, nil)
+		AssertEqual(t, n, 1)
+		_, _, err = secondary.HeadObject(context.Background(), "b")
+		AssertEqual(t, err, nil)
+	})
+}
+
+func TestMirroredS3_reconcile(t *testing.T) {
+	primary, secondary := &InMemoryS3{}, &InMemoryS3{}
+	for k, v := range map[string]string{"docs/a": "1", "docs/b": "22", "docs/c": "333", "other": "x"} {
+		AssertEqual(t, primary.PutObject(context.Background(), k, nil, strings.NewReader(v)), nil)
+	}
+	for k, v := range map[string]string{"docs/a": "1", "docs/b": "2", "docs/d": "4"} {
+		AssertEqual(t, secondary.PutObject(context.Background(), k, nil, strings.NewReader(v)), nil)
+	}
+	s := &MirroredS3{S3: primary, Secondaries: []S3{secondary}}
+	n, err := s.Reconcile(context.Background(), "docs/")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 3)
+
+	keys, sizes, _, err := secondary.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, keys, []string{"docs/a", "docs/b", "docs/c"})
+	AssertEqual(t, sizes, []int64{1, 2, 3})
+
+	n, err = s.Reconcile(context.Background(), "docs/")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 0)
+
+	// objects of the same size are compared by etag
+	AssertEqual(t, secondary.PutObject(context.Background(), "docs/c", nil, strings.NewReader("abc")), nil)
+	n, err = s.Reconcile(context.Background(), "docs/")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 1)
+	buff := new(strings.Builder)
+	_, err = secondary.GetObject(context.Background(), "docs/c", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "333")
+}
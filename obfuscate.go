@@ -0,0 +1,80 @@
+package automerge_s3_sync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeyObfuscator deterministically encrypts each "/" separated segment of an object key so that the storage provider
+// can't see document or peer ids, while listing by a prefix that ends on a segment boundary keeps working. Each segment
+// is encrypted with AES-CTR under a synthetic IV derived from an HMAC of the segment, so equal segments always produce
+// equal output and tampered segments are detected. The length of each segment is not hidden.
+type KeyObfuscator struct {
+	block  cipher.Block
+	macKey []byte
+}
+
+// NewKeyObfuscator derives the encryption and authentication keys for key obfuscation from a secret of at least 32
+// bytes.
+func NewKeyObfuscator(secret []byte) (*KeyObfuscator, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("key obfuscation secret must be at least 32 bytes")
+	}
+	block, err := aes.NewCipher(hmacSha(secret, []byte("automerge-s3-sync/key-obfuscation/enc")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise key obfuscation cipher: %w", err)
+	}
+	return &KeyObfuscator{block: block, macKey: hmacSha(secret, []byte("automerge-s3-sync/key-obfuscation/mac"))}, nil
+}
+
+func (o *KeyObfuscator) sealSegment(segment string) string {
+	if segment == "" {
+		return ""
+	}
+	out := make([]byte, aes.BlockSize+len(segment))
+	copy(out, hmacSha(o.macKey, []byte(segment))[:aes.BlockSize])
+	cipher.NewCTR(o.block, out[:aes.BlockSize]).XORKeyStream(out[aes.BlockSize:], []byte(segment))
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+func (o *KeyObfuscator) openSegment(segment string) (string, error) {
+	if segment == "" {
+		return "", nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil || len(raw) <= aes.BlockSize {
+		return "", fmt.Errorf("invalid obfuscated key segment '%s'", segment)
+	}
+	out := make([]byte, len(raw)-aes.BlockSize)
+	cipher.NewCTR(o.block, raw[:aes.BlockSize]).XORKeyStream(out, raw[aes.BlockSize:])
+	if !hmac.Equal(hmacSha(o.macKey, out)[:aes.BlockSize], raw[:aes.BlockSize]) {
+		return "", fmt.Errorf("obfuscated key segment '%s' failed authentication", segment)
+	}
+	return string(out), nil
+}
+
+// Obfuscate returns the storage key for a plaintext key.
+func (o *KeyObfuscator) Obfuscate(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = o.sealSegment(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Reveal returns the plaintext key for a storage key produced by Obfuscate.
+func (o *KeyObfuscator) Reveal(key string) (string, error) {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		var err error
+		if segments[i], err = o.openSegment(segment); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(segments, "/"), nil
+}
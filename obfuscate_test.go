@@ -0,0 +1,113 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func newTestKeyObfuscator(t *testing.T) *KeyObfuscator {
+	t.Helper()
+	o, err := NewKeyObfuscator(bytes.Repeat([]byte{1}, 32))
+	MustAssertEqual(t, err, nil)
+	return o
+}
+
+func TestKeyObfuscator(t *testing.T) {
+	o := newTestKeyObfuscator(t)
+	for _, key := range []string{"", "a", "docs/doc-1/changes/peer-1/0001", "trailing/", "/leading", "double//slash"} {
+		obfuscated := o.Obfuscate(key)
+		AssertEqual(t, obfuscated, o.Obfuscate(key))
+		AssertEqual(t, strings.Count(obfuscated, "/"), strings.Count(key, "/"))
+		if key != "" {
+			AssertEqual(t, strings.Contains(obfuscated, "doc"), false)
+		}
+		revealed, err := o.Reveal(obfuscated)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, revealed, key)
+	}
+	AssertEqual(t, strings.HasPrefix(o.Obfuscate("docs/a/b"), o.Obfuscate("docs/a/")), true)
+
+	_, err := NewKeyObfuscator([]byte("short"))
+	AssertErrorEqual(t, err, "key obfuscation secret must be at least 32 bytes")
+
+	other, err := NewKeyObfuscator(bytes.Repeat([]byte{2}, 32))
+	AssertEqual(t, err, nil)
+	_, err = other.Reveal(o.Obfuscate("docs"))
+	AssertEqual(t, err != nil, true)
+}
+
+func TestClientEncryptedS3_obfuscated(t *testing.T) {
+	testS3Interface(t, &ClientEncryptedS3{
+		S3:              &InMemoryS3{},
+		BlockCipher:     newTestBlockCipher(t),
+		EncryptMetadata: true,
+		KeyObfuscator:   newTestKeyObfuscator(t),
+	})
+}
+
+func TestClientEncryptedS3_obfuscated_storage(t *testing.T) {
+	inner := &InMemoryS3{}
+	s := &ClientEncryptedS3{
+		S3:              inner,
+		BlockCipher:     newTestBlockCipher(t),
+		EncryptMetadata: true,
+		KeyObfuscator:   newTestKeyObfuscator(t),
+	}
+	AssertEqual(t, s.PutObject(context.Background(), "docs/doc-1/changes/peer-1/1", map[string]string{"Author": "alice"}, strings.NewReader("a")), nil)
+	AssertEqual(t, s.PutObject(context.Background(), "docs/doc-1/changes/peer-2/1", nil, strings.NewReader("b")), nil)
+	AssertEqual(t, s.PutObject(context.Background(), "docs/doc-2/snapshot", nil, strings.NewReader("c")), nil)
+
+	k, _, _, err := inner.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(k), 3)
+	for _, kk := range k {
+		AssertEqual(t, strings.Contains(kk, "doc"), false)
+		_, m, err := inner.HeadObject(context.Background(), kk)
+		AssertEqual(t, err, nil)
+		for mk, mv := range m {
+			AssertEqual(t, strings.HasPrefix(mk, "cipher-"), true)
+			AssertEqual(t, strings.Contains(mv, "alice"), false)
+		}
+	}
+
+	t.Run("meta", func(t *testing.T) {
+		_, m, err := s.HeadObject(context.Background(), "docs/doc-1/changes/peer-1/1")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, m["author"], "alice")
+		buff := new(bytes.Buffer)
+		m, err = s.GetObject(context.Background(), "docs/doc-1/changes/peer-1/1", buff)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, m["author"], "alice")
+		AssertEqual(t, buff.String(), "a")
+		_, ok := m["cipher-meta"]
+		AssertEqual(t, ok, false)
+	})
+
+	t.Run("partial segment prefix", func(t *testing.T) {
+		k, _, p, err := s.ListObjects(context.Background(), "docs/doc-1/changes/peer-", "/")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, k, []string{})
+		AssertEqual(t, p, []string{"docs/doc-1/changes/peer-1/", "docs/doc-1/changes/peer-2/"})
+
+		k, _, _, err = s.ListObjects(context.Background(), "docs/doc-", "")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, k, []string{"docs/doc-1/changes/peer-1/1", "docs/doc-1/changes/peer-2/1", "docs/doc-2/snapshot"})
+	})
+
+	t.Run("unsupported delimiter", func(t *testing.T) {
+		_, _, _, err := s.ListObjects(context.Background(), "", "-")
+		AssertErrorEqual(t, err, "delimiter '-' is not supported with key obfuscation")
+	})
+
+	t.Run("re-encrypt", func(t *testing.T) {
+		s.Keyring = &Keyring{CurrentKeyId: "k1", Keys: map[string]KeyEncryptionKey{"k1": &BlockCipherKEK{BlockCipher: newTestBlockCipher(t)}}}
+		n, err := s.ReEncrypt(context.Background(), "docs/doc-1/")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, n, 2)
+		_, m, err := s.HeadObject(context.Background(), "docs/doc-1/changes/peer-1/1")
+		AssertEqual(t, err, nil)
+		AssertEqual(t, m["author"], "alice")
+	})
+}
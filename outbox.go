@@ -0,0 +1,534 @@
+package automerge_s3_sync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultOutboxReplayTimeout bounds the background replay started by each write of an OutboxS3 with no ReplayTimeout.
+const DefaultOutboxReplayTimeout = time.Second
+
+// outboxOwnedLog is the file in the Dir of an OutboxS3 that records the owned keys.
+const outboxOwnedLog = "owned.log"
+
+// OutboxS3 records every PutObject and DeleteObject in a durable queue in Dir before applying it to the underlying
+// S3, so that writes made while offline survive restarts and are uploaded in order once connectivity returns. A write
+// returns as soon as it has been queued and starts a replay of the queue in the background, bounded by ReplayTimeout
+// and skipped if another replay is running. Writes that are left in the queue are retried by Replay, which is safe to
+// call at any time because applying the same write twice is harmless.
+//
+// A write that fails with an error that can never succeed, such as ErrPermissionDenied or ErrInvalidKey, or that
+// can't be decoded is moved to the parked subdirectory of Dir so that it doesn't hold up the writes queued after it.
+// Its error is reported by LastError.
+//
+// Reads see the queued writes on top of the underlying S3, from an index of the queue kept in memory. Keys for which
+// Owned returns true, such as the change log of this peer, must only be written through this OutboxS3. Their
+// existence, size and metadata are recorded in Dir so that HeadObject and ListObjects of them are answered from that
+// record while the underlying S3 is unreachable. Owned is also called with list prefixes.
+type OutboxS3 struct {
+	S3
+	Dir           string
+	Owned         func(key string) bool
+	ReplayTimeout time.Duration
+
+	queueOnce sync.Once
+	queue     dirQueue
+	// replayMux serialises replays so that writes are applied in order.
+	replayMux sync.Mutex
+	mux       sync.Mutex
+	lastErr   error
+	// pending is the last queued write of each key, loaded from the queue on first use.
+	pending    map[string]outboxPending
+	owned      map[string]outboxOwnedEntry
+	ownedLines int
+}
+
+type outboxItem struct {
+	Op   S3Operation       `json:"op"`
+	Key  string            `json:"key"`
+	Meta map[string]string `json:"meta,omitempty"`
+	Data []byte            `json:"data,omitempty"`
+}
+
+// outboxPending is the index entry of a queued write.
+type outboxPending struct {
+	name string
+	op   S3Operation
+	size int64
+	meta map[string]string
+}
+
+// outboxOwnedEntry is a line of the owned log.
+type outboxOwnedEntry struct {
+	Key     string            `json:"key"`
+	Size    int64             `json:"size"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Deleted bool              `json:"deleted,omitempty"`
+}
+
+func (o *OutboxS3) getQueue() *dirQueue {
+	o.queueOnce.Do(func() {
+		o.queue.dir = o.Dir
+	})
+	return &o.queue
+}
+
+func (o *OutboxS3) isOwned(key string) bool {
+	return o.Owned != nil && o.Owned(key)
+}
+
+// loadOwned reads the owned log on first use. Must be called with mux held. A truncated last line, left by a crash
+// while appending, is ignored.
+func (o *OutboxS3) loadOwned() error {
+	if o.owned != nil {
+		return nil
+	}
+	owned := make(map[string]outboxOwnedEntry)
+	f, err := os.Open(filepath.Join(o.Dir, outboxOwnedLog))
+	if errors.Is(err, fs.ErrNotExist) {
+		o.owned = owned
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open owned log: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry outboxOwnedEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			break
+		}
+		o.ownedLines++
+		if entry.Deleted {
+			delete(owned, entry.Key)
+		} else {
+			owned[entry.Key] = entry
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read owned log: %w", err)
+	}
+	o.owned = owned
+	return nil
+}
+
+// recordOwned appends the entry to the owned log.
+func (o *OutboxS3) recordOwned(entry outboxOwnedEntry) error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if err := o.loadOwned(); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(&entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode owned entry: %w", err)
+	} else if err := os.MkdirAll(o.Dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create outbox: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(o.Dir, outboxOwnedLog), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open owned log: %w", err)
+	}
+	if _, err := f.Write(append(raw, '\n')); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write owned log: %w", err)
+	} else if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write owned log: %w", err)
+	} else if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write owned log: %w", err)
+	}
+	o.ownedLines++
+	if entry.Deleted {
+		delete(o.owned, entry.Key)
+	} else {
+		o.owned[entry.Key] = entry
+	}
+	return nil
+}
+
+// compactOwned rewrites the owned log with one line per owned key once most of its lines are out of date. Must be
+// called with mux held.
+func (o *OutboxS3) compactOwned() error {
+	if o.owned == nil || o.ownedLines <= 2*len(o.owned) {
+		return nil
+	}
+	f, err := os.CreateTemp(o.Dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create owned log: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	w := bufio.NewWriter(f)
+	for _, key := range slices.Sorted(maps.Keys(o.owned)) {
+		entry := o.owned[key]
+		raw, err := json.Marshal(&entry)
+		if err != nil {
+			_ = f.Close()
+			return fmt.Errorf("failed to encode owned entry: %w", err)
+		}
+		_, _ = w.Write(append(raw, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write owned log: %w", err)
+	} else if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write owned log: %w", err)
+	} else if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write owned log: %w", err)
+	} else if err := os.Rename(f.Name(), filepath.Join(o.Dir, outboxOwnedLog)); err != nil {
+		return fmt.Errorf("failed to rename owned log: %w", err)
+	}
+	o.ownedLines = len(o.owned)
+	return nil
+}
+
+// ownedEntry returns the recorded entry of an owned key.
+func (o *OutboxS3) ownedEntry(key string) (outboxOwnedEntry, bool, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if err := o.loadOwned(); err != nil {
+		return outboxOwnedEntry{}, false, err
+	}
+	entry, ok := o.owned[key]
+	return entry, ok, nil
+}
+
+// ownedUnder returns the recorded sizes of the owned keys under the prefix.
+func (o *OutboxS3) ownedUnder(prefix string) (map[string]int64, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if err := o.loadOwned(); err != nil {
+		return nil, err
+	}
+	out := make(map[string]int64)
+	for key, entry := range o.owned {
+		if strings.HasPrefix(key, prefix) {
+			out[key] = entry.Size
+		}
+	}
+	return out, nil
+}
+
+// loadPending indexes the queue on first use. Must be called with mux held. Items replayed concurrently are skipped
+// since the underlying S3 has them by then, and items that can't be decoded are left for replay to park.
+func (o *OutboxS3) loadPending() error {
+	if o.pending != nil {
+		return nil
+	}
+	q := o.getQueue()
+	names, err := q.names()
+	if err != nil {
+		return err
+	}
+	pending := make(map[string]outboxPending, len(names))
+	for _, name := range names {
+		item := new(outboxItem)
+		if err := q.read(name, item); errors.Is(err, fs.ErrNotExist) || errors.Is(err, errCorruptQueueItem) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		pending[item.Key] = outboxPending{name: name, op: item.Op, size: int64(len(item.Data)), meta: item.Meta}
+	}
+	o.pending = pending
+	return nil
+}
+
+// push queues the item and indexes it as the last write of its key.
+func (o *OutboxS3) push(item *outboxItem) error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if err := o.loadPending(); err != nil {
+		return err
+	}
+	name, err := o.getQueue().push(item)
+	if err != nil {
+		return err
+	}
+	o.pending[item.Key] = outboxPending{name: name, op: item.Op, size: int64(len(item.Data)), meta: item.Meta}
+	return nil
+}
+
+// dropPending removes the named queue item from the index, unless a later write to the key has replaced it.
+func (o *OutboxS3) dropPending(key, name string) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if p, ok := o.pending[key]; ok && p.name == name {
+		delete(o.pending, key)
+	}
+}
+
+// pendingEntry returns the last queued write of the key.
+func (o *OutboxS3) pendingEntry(key string) (outboxPending, bool, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if err := o.loadPending(); err != nil {
+		return outboxPending{}, false, err
+	}
+	p, ok := o.pending[key]
+	return p, ok, nil
+}
+
+// pendingUnder returns the last queued write of each key under the prefix.
+func (o *OutboxS3) pendingUnder(prefix string) (map[string]outboxPending, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if err := o.loadPending(); err != nil {
+		return nil, err
+	}
+	out := make(map[string]outboxPending)
+	for key, p := range o.pending {
+		if strings.HasPrefix(key, prefix) {
+			out[key] = p
+		}
+	}
+	return out, nil
+}
+
+// Depth returns the number of writes waiting to be uploaded.
+func (o *OutboxS3) Depth() (int, error) {
+	names, err := o.getQueue().names()
+	return len(names), err
+}
+
+// LastError returns the error of the last replay, joined with the errors of the writes it parked, or nil if it
+// succeeded without parking any.
+func (o *OutboxS3) LastError() error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return o.lastErr
+}
+
+func (o *OutboxS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
+	p, ok, err := o.pendingEntry(key)
+	if err != nil {
+		return nil, err
+	} else if ok && p.op == OpDeleteObject {
+		return nil, ErrObjectNotFound
+	} else if ok {
+		// the body is only kept in the queue, which the underlying S3 has if it was replayed in the meantime
+		item := new(outboxItem)
+		if err := o.getQueue().read(p.name, item); errors.Is(err, fs.ErrNotExist) {
+			return o.S3.GetObject(ctx, key, dst)
+		} else if err != nil {
+			return nil, err
+		} else if _, err := dst.Write(item.Data); err != nil {
+			return nil, fmt.Errorf("failed to write: %w", err)
+		}
+		meta = maps.Clone(item.Meta)
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		return meta, nil
+	}
+	return o.S3.GetObject(ctx, key, dst)
+}
+
+func (o *OutboxS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
+	if p, ok, err := o.pendingEntry(key); err != nil {
+		return 0, nil, err
+	} else if ok {
+		if p.op == OpDeleteObject {
+			return 0, nil, ErrObjectNotFound
+		}
+		meta = maps.Clone(p.meta)
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		return p.size, meta, nil
+	}
+	size, meta, err = o.S3.HeadObject(ctx, key)
+	if shouldFallback(ctx, err) && o.isOwned(key) {
+		if entry, ok, err := o.ownedEntry(key); err != nil {
+			return 0, nil, err
+		} else if !ok {
+			return 0, nil, ErrObjectNotFound
+		} else {
+			meta = maps.Clone(entry.Meta)
+			if meta == nil {
+				meta = map[string]string{}
+			}
+			return entry.Size, meta, nil
+		}
+	}
+	return size, meta, err
+}
+
+func (o *OutboxS3) ListObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	pending, err := o.pendingUnder(prefix)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	merged := make(map[string]int64)
+	commonPrefixes := make(map[string]bool)
+	add := func(key string, size int64) {
+		if rest := key[len(prefix):]; delimiter != "" && strings.Contains(rest, delimiter) {
+			commonPrefixes[prefix+rest[:strings.Index(rest, delimiter)+len(delimiter)]] = true
+		} else {
+			merged[key] = size
+		}
+	}
+
+	keys, sizes, prefixes, err = o.S3.ListObjects(ctx, prefix, delimiter)
+	if shouldFallback(ctx, err) && o.isOwned(prefix) {
+		owned, err := o.ownedUnder(prefix)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for key, size := range owned {
+			add(key, size)
+		}
+	} else if err != nil {
+		return nil, nil, nil, err
+	} else {
+		for i, key := range keys {
+			merged[key] = sizes[i]
+		}
+		for _, p := range prefixes {
+			commonPrefixes[p] = true
+		}
+	}
+
+	for key, p := range pending {
+		if p.op == OpDeleteObject {
+			delete(merged, key)
+		} else {
+			add(key, p.size)
+		}
+	}
+	keys = slices.AppendSeq(make([]string, 0, len(merged)), maps.Keys(merged))
+	slices.Sort(keys)
+	sizes = make([]int64, len(keys))
+	for i, key := range keys {
+		sizes[i] = merged[key]
+	}
+	prefixes = slices.AppendSeq(make([]string, 0, len(commonPrefixes)), maps.Keys(commonPrefixes))
+	slices.Sort(prefixes)
+	return keys, sizes, prefixes, nil
+}
+
+func (o *OutboxS3) enqueue(ctx context.Context, item *outboxItem) error {
+	if err := o.push(item); err != nil {
+		return fmt.Errorf("failed to queue %s: %w", item.Op, err)
+	}
+	// recorded once queued, so that the record never has a write that was lost
+	if o.isOwned(item.Key) {
+		entry := outboxOwnedEntry{Key: item.Key, Size: int64(len(item.Data)), Meta: item.Meta, Deleted: item.Op == OpDeleteObject}
+		if err := o.recordOwned(entry); err != nil {
+			return fmt.Errorf("failed to record %s: %w", item.Op, err)
+		}
+	}
+	if o.replayMux.TryLock() {
+		timeout := o.ReplayTimeout
+		if timeout <= 0 {
+			timeout = DefaultOutboxReplayTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		go func() {
+			defer cancel()
+			_, _ = o.replay(ctx)
+		}()
+	}
+	return nil
+}
+
+func (o *OutboxS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to buffer data: %w", err)
+	}
+	return o.enqueue(ctx, &outboxItem{Op: OpPutObject, Key: key, Meta: meta, Data: data})
+}
+
+func (o *OutboxS3) DeleteObject(ctx context.Context, key string) error {
+	return o.enqueue(ctx, &outboxItem{Op: OpDeleteObject, Key: key})
+}
+
+// isPermanentReplayError reports whether replaying a queued write can never succeed.
+func isPermanentReplayError(err error) bool {
+	return errors.Is(err, errCorruptQueueItem) || errors.Is(err, errors.ErrUnsupported) ||
+		errors.Is(err, ErrPermissionDenied) || errors.Is(err, ErrInvalidKey)
+}
+
+// Replay applies the queued writes in order and returns how many were applied. It stops at the first write that
+// fails, leaving it and the rest in the queue, unless the write can never succeed and is parked instead. The errors
+// are recorded for LastError.
+func (o *OutboxS3) Replay(ctx context.Context) (replayed int, err error) {
+	o.replayMux.Lock()
+	return o.replay(ctx)
+}
+
+// replay is Replay with replayMux already held, which it releases.
+func (o *OutboxS3) replay(ctx context.Context) (replayed int, err error) {
+	defer o.replayMux.Unlock()
+	var parked []error
+	defer func() {
+		o.mux.Lock()
+		defer o.mux.Unlock()
+		if compactErr := o.compactOwned(); err == nil {
+			err = compactErr
+		}
+		o.lastErr = errors.Join(append(parked, err)...)
+	}()
+	q := o.getQueue()
+	names, err := q.names()
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		item := new(outboxItem)
+		if err = q.read(name, item); err == nil {
+			switch item.Op {
+			case OpPutObject:
+				err = o.S3.PutObject(ctx, item.Key, item.Meta, bytes.NewReader(item.Data))
+			case OpDeleteObject:
+				err = o.S3.DeleteObject(ctx, item.Key)
+			default:
+				err = fmt.Errorf("queue item %s has unsupported operation '%s': %w", name, item.Op, errors.ErrUnsupported)
+			}
+			if err != nil {
+				err = fmt.Errorf("failed to replay %s '%s': %w", item.Op, item.Key, err)
+			}
+		}
+		if err != nil && isPermanentReplayError(err) {
+			if err := q.park(name); err != nil {
+				return replayed, err
+			}
+			parked = append(parked, fmt.Errorf("parked queue item %s: %w", name, err))
+		} else if err != nil {
+			return replayed, err
+		} else if err := q.remove(name); err != nil {
+			return replayed, err
+		} else {
+			replayed++
+		}
+		if item.Key != "" {
+			o.dropPending(item.Key, name)
+		}
+	}
+	return replayed, nil
+}
+
+// RunReplay calls Replay every interval until the context is cancelled. Failures are retried on the next interval.
+func (o *OutboxS3) RunReplay(ctx context.Context, interval time.Duration) error {
+	return runReplay(ctx, interval, o.Replay)
+}
+
+var _ S3 = (*OutboxS3)(nil)
@@ -0,0 +1,267 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboxS3(t *testing.T) {
+	testS3Interface(t, &OutboxS3{S3: &InMemoryS3{}, Dir: t.TempDir()})
+}
+
+// waitReplay waits for the background replay started by the last write to finish.
+func waitReplay(o *OutboxS3) {
+	o.replayMux.Lock()
+	defer o.replayMux.Unlock()
+}
+
+func TestOutboxS3_offline(t *testing.T) {
+	inner := &InMemoryS3{}
+	offline := &FaultyS3{S3: inner, Rules: []*FaultRule{{Kind: FaultError, Ops: []S3Operation{OpPutObject, OpDeleteObject}}}}
+	dir := t.TempDir()
+	o := &OutboxS3{S3: offline, Dir: dir}
+
+	AssertEqual(t, o.PutObject(context.Background(), "a", map[string]string{"x": "y"}, strings.NewReader("one")), nil)
+	AssertEqual(t, o.PutObject(context.Background(), "b", nil, strings.NewReader("two")), nil)
+	AssertEqual(t, o.DeleteObject(context.Background(), "a"), nil)
+	AssertEqual(t, o.PutObject(context.Background(), "a", nil, strings.NewReader("three")), nil)
+	depth, err := o.Depth()
+	AssertEqual(t, err, nil)
+	AssertEqual(t, depth, 4)
+	waitReplay(o)
+	AssertErrorIs(t, o.LastError(), ErrInjectedFault)
+
+	// the queue survives a restart and is replayed in order once back online
+	offline.Rules = nil
+	o = &OutboxS3{S3: offline, Dir: dir}
+	n, err := o.Replay(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 4)
+	AssertEqual(t, o.LastError(), nil)
+	depth, _ = o.Depth()
+	AssertEqual(t, depth, 0)
+
+	buff := new(bytes.Buffer)
+	_, err = inner.GetObject(context.Background(), "a", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "three")
+	buff.Reset()
+	m, err := inner.GetObject(context.Background(), "b", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "two")
+	AssertEqual(t, len(m), 0)
+}
+
+func TestOutboxS3_partial_replay(t *testing.T) {
+	inner := &InMemoryS3{}
+	flaky := &FaultyS3{S3: inner, Rules: []*FaultRule{{Kind: FaultError, Ops: []S3Operation{OpPutObject}, KeyPrefix: "b"}}}
+	o := &OutboxS3{S3: flaky, Dir: t.TempDir()}
+	for _, key := range []string{"a", "b", "c"} {
+		AssertEqual(t, o.PutObject(context.Background(), key, nil, strings.NewReader(key)), nil)
+	}
+	_, err := o.Replay(context.Background())
+	AssertErrorIs(t, err, ErrInjectedFault)
+	keys, _, _, _ := inner.ListObjects(context.Background(), "", "")
+	AssertEqual(t, keys, []string{"a"})
+	depth, _ := o.Depth()
+	AssertEqual(t, depth, 2)
+}
+
+func TestOutboxS3_reads_see_queue(t *testing.T) {
+	inner := &InMemoryS3{}
+	AssertEqual(t, inner.PutObject(context.Background(), "dir/a", nil, strings.NewReader("one")), nil)
+	AssertEqual(t, inner.PutObject(context.Background(), "dir/b", nil, strings.NewReader("two")), nil)
+	readOnly := &FaultyS3{S3: inner, Rules: []*FaultRule{{Kind: FaultError, Ops: []S3Operation{OpPutObject, OpDeleteObject}}}}
+	o := &OutboxS3{S3: readOnly, Dir: t.TempDir()}
+	AssertEqual(t, o.PutObject(context.Background(), "dir/c", map[string]string{"x": "y"}, strings.NewReader("three")), nil)
+	AssertEqual(t, o.PutObject(context.Background(), "dir/sub/d", nil, strings.NewReader("four")), nil)
+	AssertEqual(t, o.DeleteObject(context.Background(), "dir/a"), nil)
+
+	buff := new(bytes.Buffer)
+	meta, err := o.GetObject(context.Background(), "dir/c", buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "three")
+	AssertEqual(t, meta, map[string]string{"x": "y"})
+	size, _, err := o.HeadObject(context.Background(), "dir/c")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, size, int64(5))
+	_, _, err = o.HeadObject(context.Background(), "dir/a")
+	AssertErrorIs(t, err, ErrObjectNotFound)
+
+	keys, sizes, prefixes, err := o.ListObjects(context.Background(), "dir/", "/")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, keys, []string{"dir/b", "dir/c"})
+	AssertEqual(t, sizes, []int64{3, 5})
+	AssertEqual(t, prefixes, []string{"dir/sub/"})
+}
+
+func TestOutboxS3_bounded_replay(t *testing.T) {
+	hanging := &FaultyS3{S3: &InMemoryS3{}, Rules: []*FaultRule{{Kind: FaultLatency, Ops: []S3Operation{OpPutObject}, Latency: time.Hour}}}
+	o := &OutboxS3{S3: hanging, Dir: t.TempDir(), ReplayTimeout: 10 * time.Millisecond}
+	start := time.Now()
+	AssertEqual(t, o.PutObject(context.Background(), "a", nil, strings.NewReader("one")), nil)
+	waitReplay(o)
+	AssertEqual(t, time.Since(start) < time.Minute, true)
+	AssertErrorIs(t, o.LastError(), context.DeadlineExceeded)
+	depth, _ := o.Depth()
+	AssertEqual(t, depth, 1)
+}
+
+func TestOutboxS3_change_log_offline(t *testing.T) {
+	inner := &InMemoryS3{}
+	backend := &FaultyS3{S3: inner}
+	dir := t.TempDir()
+	o := &OutboxS3{S3: backend, Dir: dir, Owned: PeerChangeKeys("peer-a")}
+	c := &ChangeLog{S3: o, DocumentId: "doc-1"}
+	AssertEqual(t, c.Append(context.Background(), "peer-a", 1, nil, strings.NewReader("one")), nil)
+	waitReplay(o)
+
+	// fully offline, including across a restart
+	backend.Rules = []*FaultRule{{Kind: FaultError}}
+	AssertEqual(t, c.Append(context.Background(), "peer-a", 2, nil, strings.NewReader("two")), nil)
+	waitReplay(o)
+	o = &OutboxS3{S3: backend, Dir: dir, Owned: PeerChangeKeys("peer-a")}
+	c = &ChangeLog{S3: o, DocumentId: "doc-1"}
+	AssertErrorIs(t, c.Append(context.Background(), "peer-a", 1, nil, strings.NewReader("again")), ErrChangeExists)
+	AssertErrorIs(t, c.Append(context.Background(), "peer-a", 2, nil, strings.NewReader("again")), ErrChangeExists)
+	AssertEqual(t, c.Append(context.Background(), "peer-a", 3, nil, strings.NewReader("three")), nil)
+	refs, err := c.PeerChanges(context.Background(), "peer-a", 0)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(refs), 3)
+	// other peers' change logs can't be read while offline
+	_, err = c.PeerChanges(context.Background(), "peer-b", 0)
+	AssertErrorIs(t, err, ErrInjectedFault)
+
+	waitReplay(o)
+	backend.Rules = nil
+	_, err = o.Replay(context.Background())
+	AssertEqual(t, err, nil)
+	keys, _, _, err := inner.ListObjects(context.Background(), ChangesPrefix("doc-1"), "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(keys), 3)
+}
+
+func TestOutboxS3_repo(t *testing.T) {
+	inner := &InMemoryS3{}
+	backend := &FaultyS3{S3: inner}
+	dir := t.TempDir()
+	var o *OutboxS3
+	open := func() *Document {
+		o = &OutboxS3{S3: backend, Dir: dir, Owned: PeerChangeKeys("peer-a")}
+		r, err := NewRepo(o, RepoOptions{PeerId: "peer-a"})
+		MustAssertEqual(t, err, nil)
+		doc, err := r.Open(context.Background(), "doc-1")
+		MustAssertEqual(t, err, nil)
+		return doc
+	}
+	o = &OutboxS3{S3: backend, Dir: dir, Owned: PeerChangeKeys("peer-a")}
+	r, err := NewRepo(o, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	doc, err := r.Create(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+	_, err = doc.Append(context.Background(), nil, strings.NewReader("one"))
+	AssertEqual(t, err, nil)
+	waitReplay(o)
+
+	// appends while offline are queued
+	backend.Rules = []*FaultRule{{Kind: FaultError}}
+	ref, err := doc.Append(context.Background(), nil, strings.NewReader("two"))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, ref.Seq, uint64(2))
+	waitReplay(o)
+
+	// after a restart with the queue still pending, the sequence continues after the queued changes
+	backend.Rules = []*FaultRule{{Kind: FaultError, Ops: []S3Operation{OpPutObject, OpDeleteObject}}}
+	doc = open()
+	ref, err = doc.Append(context.Background(), nil, strings.NewReader("three"))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, ref.Seq, uint64(3))
+	waitReplay(o)
+
+	backend.Rules = nil
+	ref, err = open().Append(context.Background(), nil, strings.NewReader("four"))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, ref.Seq, uint64(4))
+	_, err = o.Replay(context.Background())
+	AssertEqual(t, err, nil)
+	keys, _, _, err := inner.ListObjects(context.Background(), ChangesPrefix("doc-1"), "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(keys), 4)
+	for i, want := range []string{"one", "two", "three", "four"} {
+		buff := new(bytes.Buffer)
+		_, err := inner.GetObject(context.Background(), ChangeKey("doc-1", "peer-a", uint64(i+1)), buff)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, buff.String(), want)
+	}
+}
+
+func TestOutboxS3_write_does_not_wait(t *testing.T) {
+	hanging := &FaultyS3{S3: &InMemoryS3{}, Rules: []*FaultRule{{Kind: FaultLatency, Ops: []S3Operation{OpPutObject}, Latency: time.Hour}}}
+	o := &OutboxS3{S3: hanging, Dir: t.TempDir(), ReplayTimeout: 200 * time.Millisecond}
+	start := time.Now()
+	AssertEqual(t, o.PutObject(context.Background(), "a", nil, strings.NewReader("one")), nil)
+	AssertEqual(t, time.Since(start) < 100*time.Millisecond, true)
+	waitReplay(o)
+	AssertErrorIs(t, o.LastError(), context.DeadlineExceeded)
+}
+
+func TestOutboxS3_parked(t *testing.T) {
+	inner := &InMemoryS3{}
+	denied := &PolicyS3{S3: inner, Rules: []PolicyRule{{Effect: PolicyDeny, KeyPrefix: "b"}}}
+	dir := t.TempDir()
+	offline := &FaultyS3{S3: denied, Rules: []*FaultRule{{Kind: FaultError}}}
+	o := &OutboxS3{S3: offline, Dir: dir}
+	for _, key := range []string{"a", "b", "c"} {
+		AssertEqual(t, o.PutObject(context.Background(), key, nil, strings.NewReader(key)), nil)
+	}
+	waitReplay(o)
+	AssertEqual(t, os.WriteFile(filepath.Join(dir, "00000000000000000010.json"), []byte("{"), 0o600), nil)
+
+	// the denied write and the corrupt item are parked rather than holding up the rest of the queue
+	offline.Rules = nil
+	n, err := o.Replay(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, 2)
+	AssertErrorIs(t, o.LastError(), ErrPermissionDenied)
+	AssertErrorIs(t, o.LastError(), errCorruptQueueItem)
+	depth, _ := o.Depth()
+	AssertEqual(t, depth, 0)
+	parked, err := queueNames(filepath.Join(dir, dirQueueParked))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, parked, []string{"00000000000000000002.json", "00000000000000000010.json"})
+	keys, _, _, _ := inner.ListObjects(context.Background(), "", "")
+	AssertEqual(t, keys, []string{"a", "c"})
+
+	// new items are numbered after the parked ones
+	o = &OutboxS3{S3: inner, Dir: dir}
+	AssertEqual(t, o.PutObject(context.Background(), "d", nil, strings.NewReader("d")), nil)
+	waitReplay(o)
+	AssertEqual(t, o.LastError(), nil)
+	_, _, err = o.HeadObject(context.Background(), "b")
+	AssertErrorIs(t, err, ErrObjectNotFound)
+}
+
+func TestOutboxS3_owned_log_compaction(t *testing.T) {
+	dir := t.TempDir()
+	o := &OutboxS3{S3: &InMemoryS3{}, Dir: dir, Owned: func(string) bool { return true }}
+	for i := range 10 {
+		AssertEqual(t, o.PutObject(context.Background(), "a", nil, strings.NewReader(strings.Repeat("x", i))), nil)
+	}
+	AssertEqual(t, o.DeleteObject(context.Background(), "b"), nil)
+	_, err := o.Replay(context.Background())
+	AssertEqual(t, err, nil)
+
+	raw, err := os.ReadFile(filepath.Join(dir, outboxOwnedLog))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, string(raw), `{"key":"a","size":9}`+"\n")
+	// the compacted log is read back after a restart
+	o = &OutboxS3{S3: &FaultyS3{S3: &InMemoryS3{}, Rules: []*FaultRule{{Kind: FaultError}}}, Dir: dir, Owned: func(string) bool { return true }}
+	size, _, err := o.HeadObject(context.Background(), "a")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, size, int64(9))
+}
@@ -0,0 +1,122 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// ErrWrongPassphrase is returned when a passphrase does not match the verifier stored in the bucket.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// DefaultPassphraseParamsKey is the well-known object that holds the PassphraseParams of a bucket.
+const DefaultPassphraseParamsKey = "passphrase-params.json"
+
+// PassphraseParams are the Argon2id parameters and salt used to derive a key from a passphrase, along with a verifier
+// that allows a wrong passphrase to be detected without trying to decrypt any objects. They are stored unencrypted in
+// the bucket so that every client derives the same key.
+type PassphraseParams struct {
+	Algorithm string `json:"algorithm"`
+	Time      uint32 `json:"time"`
+	MemoryKiB uint32 `json:"memory_kib"`
+	Threads   uint8  `json:"threads"`
+	Salt      []byte `json:"salt"`
+	Verifier  []byte `json:"verifier"`
+}
+
+// DefaultPassphraseParams follow the second recommended option of RFC 9106.
+var DefaultPassphraseParams = PassphraseParams{Algorithm: "argon2id", Time: 3, MemoryKiB: 64 * 1024, Threads: 4}
+
+// The params are read from the unencrypted bucket, so they are bounded to stop anyone who can write to it from making
+// every client allocate unbounded memory or spin.
+const (
+	maxPassphraseTime      = 16
+	maxPassphraseMemoryKiB = 1024 * 1024
+	maxPassphraseThreads   = 64
+)
+
+// derive returns the encryption key and the verifier for the passphrase.
+func (p *PassphraseParams) derive(passphrase []byte) (key []byte, verifier []byte, err error) {
+	if p.Algorithm != "argon2id" {
+		return nil, nil, fmt.Errorf("passphrase algorithm '%s' is not supported", p.Algorithm)
+	} else if p.Time == 0 || p.Threads == 0 || p.MemoryKiB < 8*uint32(p.Threads) || len(p.Salt) < 16 {
+		return nil, nil, errors.New("passphrase params are invalid")
+	} else if p.Time > maxPassphraseTime || p.MemoryKiB > maxPassphraseMemoryKiB || p.Threads > maxPassphraseThreads {
+		return nil, nil, errors.New("passphrase params exceed the supported limits")
+	}
+	out := argon2.IDKey(passphrase, p.Salt, p.Time, p.MemoryKiB, p.Threads, 64)
+	return out[:32], hmacSha(out[32:], []byte("automerge-s3-sync/passphrase-verifier")), nil
+}
+
+func readPassphraseParams(ctx context.Context, s3 S3, paramsKey string) (*PassphraseParams, error) {
+	buff := new(bytes.Buffer)
+	if _, err := s3.GetObject(ctx, paramsKey, buff); err != nil {
+		return nil, err
+	}
+	params := new(PassphraseParams)
+	if err := json.Unmarshal(buff.Bytes(), params); err != nil {
+		return nil, fmt.Errorf("failed to decode passphrase params: %w", err)
+	}
+	return params, nil
+}
+
+// writePassphraseParams creates the params object, only if it doesn't exist yet when the S3 supports it. Losing that
+// race is not an error since the caller reads back the winner's params.
+func writePassphraseParams(ctx context.Context, s3 S3, paramsKey string, raw []byte) error {
+	if putter, ok := s3.(ConditionalPutter); ok {
+		if _, err := putter.PutObjectIf(ctx, paramsKey, nil, bytes.NewReader(raw), PutCondition{IfNoneMatch: true}); err != nil && !errors.Is(err, ErrPreconditionFailed) {
+			return err
+		}
+		return nil
+	}
+	return s3.PutObject(ctx, paramsKey, nil, bytes.NewReader(raw))
+}
+
+// PassphraseBlockCipher derives an AES-256 cipher from the passphrase, suitable for the BlockCipher of
+// ClientEncryptedS3. The parameters are read from the paramsKey object in the given (unencrypted) S3. If it doesn't
+// exist yet, it is created from the defaults with a fresh salt. Returns ErrWrongPassphrase if the passphrase does not
+// match the stored verifier.
+//
+// When the S3 implements ConditionalPutter the parameters are only created if they don't exist yet, and a client that
+// loses the race to create them uses the winner's. Otherwise two clients creating the parameters at the same time may
+// race. The object is read back after creation so that the last writer wins consistently, but data written in the
+// meantime by the losing client would be unreadable, so the first client should be given a chance to initialise the
+// bucket.
+func PassphraseBlockCipher(ctx context.Context, s3 S3, paramsKey string, passphrase []byte, defaults PassphraseParams) (cipher.Block, error) {
+	params, err := readPassphraseParams(ctx, s3, paramsKey)
+	if errors.Is(err, ErrObjectNotFound) {
+		params = &defaults
+		params.Salt = make([]byte, 32)
+		if _, err := rand.Read(params.Salt); err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %w", err)
+		} else if _, params.Verifier, err = params.derive(passphrase); err != nil {
+			return nil, err
+		} else if raw, err := json.Marshal(params); err != nil {
+			return nil, fmt.Errorf("failed to encode passphrase params: %w", err)
+		} else if err := writePassphraseParams(ctx, s3, paramsKey, raw); err != nil {
+			return nil, fmt.Errorf("failed to write passphrase params: %w", err)
+		} else if params, err = readPassphraseParams(ctx, s3, paramsKey); err != nil {
+			return nil, fmt.Errorf("failed to read back passphrase params: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase params: %w", err)
+	}
+
+	if key, verifier, err := params.derive(passphrase); err != nil {
+		return nil, err
+	} else if !hmac.Equal(verifier, params.Verifier) {
+		return nil, ErrWrongPassphrase
+	} else if block, err := aes.NewCipher(key); err != nil {
+		return nil, fmt.Errorf("failed to initialise cipher: %w", err)
+	} else {
+		return block, nil
+	}
+}
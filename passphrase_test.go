@@ -0,0 +1,96 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"io"
+	"strings"
+	"testing"
+)
+
+var testPassphraseParams = PassphraseParams{Algorithm: "argon2id", Time: 1, MemoryKiB: 64, Threads: 1}
+
+func TestPassphraseBlockCipher(t *testing.T) {
+	inner := &InMemoryS3{}
+	bc, err := PassphraseBlockCipher(context.Background(), inner, DefaultPassphraseParamsKey, []byte("correct horse"), testPassphraseParams)
+	MustAssertEqual(t, err, nil)
+	s := &ClientEncryptedS3{S3: inner, BlockCipher: bc}
+	AssertEqual(t, s.PutObject(context.Background(), "docs/a", nil, strings.NewReader("secret")), nil)
+
+	t.Run("same passphrase", func(t *testing.T) {
+		bc, err := PassphraseBlockCipher(context.Background(), inner, DefaultPassphraseParamsKey, []byte("correct horse"), DefaultPassphraseParams)
+		MustAssertEqual(t, err, nil)
+		buff := new(bytes.Buffer)
+		_, err = (&ClientEncryptedS3{S3: inner, BlockCipher: bc}).GetObject(context.Background(), "docs/a", buff)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, buff.String(), "secret")
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		_, err := PassphraseBlockCipher(context.Background(), inner, DefaultPassphraseParamsKey, []byte("battery staple"), testPassphraseParams)
+		AssertErrorIs(t, err, ErrWrongPassphrase)
+	})
+
+	t.Run("params are stored", func(t *testing.T) {
+		params, err := readPassphraseParams(context.Background(), inner, DefaultPassphraseParamsKey)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, params.MemoryKiB, uint32(64))
+		AssertEqual(t, len(params.Salt), 32)
+		AssertEqual(t, len(params.Verifier), 32)
+	})
+}
+
+func TestPassphraseBlockCipher_invalid_params(t *testing.T) {
+	inner := &InMemoryS3{}
+	AssertEqual(t, inner.PutObject(context.Background(), DefaultPassphraseParamsKey, nil, strings.NewReader(`{"algorithm":"scrypt"}`)), nil)
+	_, err := PassphraseBlockCipher(context.Background(), inner, DefaultPassphraseParamsKey, []byte("x"), testPassphraseParams)
+	AssertErrorEqual(t, err, "passphrase algorithm 'scrypt' is not supported")
+
+	AssertEqual(t, inner.PutObject(context.Background(), DefaultPassphraseParamsKey, nil, strings.NewReader(`{"algorithm":"argon2id"}`)), nil)
+	_, err = PassphraseBlockCipher(context.Background(), inner, DefaultPassphraseParamsKey, []byte("x"), testPassphraseParams)
+	AssertErrorEqual(t, err, "passphrase params are invalid")
+}
+
+// racingS3 runs a function in place of the first GetObject and reports the object as missing, as if another client
+// created it just after it was read.
+type racingS3 struct {
+	*InMemoryS3
+	race func()
+}
+
+func (s *racingS3) GetObject(ctx context.Context, key string, dst io.Writer) (map[string]string, error) {
+	if s.race != nil {
+		race := s.race
+		s.race = nil
+		race()
+		return nil, ErrObjectNotFound
+	}
+	return s.InMemoryS3.GetObject(ctx, key, dst)
+}
+
+func TestPassphraseBlockCipher_creation_race(t *testing.T) {
+	inner := &InMemoryS3{}
+	var winner cipher.Block
+	s := &racingS3{InMemoryS3: inner, race: func() {
+		var err error
+		winner, err = PassphraseBlockCipher(context.Background(), inner, DefaultPassphraseParamsKey, []byte("correct horse"), testPassphraseParams)
+		AssertEqual(t, err, nil)
+	}}
+	bc, err := PassphraseBlockCipher(context.Background(), s, DefaultPassphraseParamsKey, []byte("correct horse"), testPassphraseParams)
+	MustAssertEqual(t, err, nil)
+
+	// the loser derives the same key from the winner's params
+	a, b := make([]byte, 16), make([]byte, 16)
+	winner.Encrypt(a, make([]byte, 16))
+	bc.Encrypt(b, make([]byte, 16))
+	AssertEqual(t, a, b)
+}
+
+func TestPassphraseBlockCipher_limits(t *testing.T) {
+	inner := &InMemoryS3{}
+	raw := `{"algorithm":"argon2id","time":1,"memory_kib":4294967295,"threads":1,"salt":"AAAAAAAAAAAAAAAAAAAAAA=="}`
+	AssertEqual(t, inner.PutObject(context.Background(), DefaultPassphraseParamsKey, nil, strings.NewReader(raw)), nil)
+	_, err := PassphraseBlockCipher(context.Background(), inner, DefaultPassphraseParamsKey, []byte("x"), testPassphraseParams)
+	AssertErrorEqual(t, err, "passphrase params exceed the supported limits")
+}
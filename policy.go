@@ -0,0 +1,173 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ErrPermissionDenied is wrapped by the *PermissionError returned when a PolicyS3 rejects an operation.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// PermissionError describes an operation rejected by a PolicyS3.
+type PermissionError struct {
+	Op     S3Operation
+	Key    string
+	Reason string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s: %s '%s': %s", ErrPermissionDenied, e.Op, e.Key, e.Reason)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return ErrPermissionDenied
+}
+
+// PolicyEffect is whether a matching PolicyRule allows or denies the operation.
+type PolicyEffect int
+
+const (
+	PolicyAllow PolicyEffect = iota
+	PolicyDeny
+)
+
+// PolicyRule matches operations on keys. A rule matches when all of its conditions hold.
+type PolicyRule struct {
+	Effect PolicyEffect
+	// Ops limits the rule to these operations. Empty matches every operation.
+	Ops []S3Operation
+	// KeyPrefix limits the rule to object keys (or list prefixes) starting with this prefix.
+	KeyPrefix string
+	// Pattern limits the rule to object keys (or list prefixes) matching this path.Match pattern.
+	Pattern string
+}
+
+func (r *PolicyRule) matches(op S3Operation, key string) bool {
+	if len(r.Ops) > 0 && !slices.Contains(r.Ops, op) {
+		return false
+	} else if !strings.HasPrefix(key, r.KeyPrefix) {
+		return false
+	} else if r.Pattern != "" {
+		if ok, err := path.Match(r.Pattern, key); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// validatePolicyKey rejects keys that stores may normalise into a different key than the one the rules were checked
+// against, namely absolute keys and keys with empty, "." or ".." segments. List prefixes may be empty or end with "/".
+func validatePolicyKey(key string, isPrefix bool) error {
+	if isPrefix {
+		if key == "" {
+			return nil
+		}
+		key = strings.TrimSuffix(key, "/")
+	}
+	if strings.HasPrefix(key, "/") {
+		return fmt.Errorf("%w: '%s' is absolute", ErrInvalidKey, key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("%w: '%s' contains an empty, '.' or '..' segment", ErrInvalidKey, key)
+		}
+	}
+	return nil
+}
+
+// PolicyS3 rejects operations on the underlying S3 that its policy doesn't permit, without making any request. When
+// ReadOnly is set, PutObject and DeleteObject are always rejected. Otherwise the first of the Rules that matches the
+// operation and key decides, and operations that match no rule are allowed unless DefaultDeny is set. Keys that are
+// absolute or have empty, "." or ".." segments are rejected with ErrInvalidKey before any rule is evaluated, since
+// stores that normalise paths would otherwise address a key the rules never saw.
+//
+// ListObjects checks the rules against the listed prefix and also drops the returned keys and common prefixes that
+// the rules wouldn't allow listing directly, so that a broad listing doesn't reveal names under a denied prefix.
+type PolicyS3 struct {
+	S3
+	ReadOnly    bool
+	Rules       []PolicyRule
+	DefaultDeny bool
+}
+
+func (p *PolicyS3) check(op S3Operation, key string) error {
+	if err := validatePolicyKey(key, op == OpListObjects); err != nil {
+		return err
+	}
+	return p.evaluate(op, key)
+}
+
+// evaluate applies the rules to an operation on a key that has already been validated.
+func (p *PolicyS3) evaluate(op S3Operation, key string) error {
+	if p.ReadOnly && (op == OpPutObject || op == OpDeleteObject) {
+		return &PermissionError{Op: op, Key: key, Reason: "read-only"}
+	}
+	for i, rule := range p.Rules {
+		if rule.matches(op, key) {
+			if rule.Effect == PolicyDeny {
+				return &PermissionError{Op: op, Key: key, Reason: fmt.Sprintf("denied by rule %d", i)}
+			}
+			return nil
+		}
+	}
+	if p.DefaultDeny {
+		return &PermissionError{Op: op, Key: key, Reason: "no rule allows it"}
+	}
+	return nil
+}
+
+func (p *PolicyS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
+	if err := p.check(OpGetObject, key); err != nil {
+		return nil, err
+	}
+	return p.S3.GetObject(ctx, key, dst)
+}
+
+func (p *PolicyS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
+	if err := p.check(OpHeadObject, key); err != nil {
+		return 0, nil, err
+	}
+	return p.S3.HeadObject(ctx, key)
+}
+
+func (p *PolicyS3) ListObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	if err := p.check(OpListObjects, prefix); err != nil {
+		return nil, nil, nil, err
+	} else if keys, sizes, prefixes, err = p.S3.ListObjects(ctx, prefix, delimiter); err != nil {
+		return nil, nil, nil, err
+	}
+	outKeys, outSizes := make([]string, 0, len(keys)), make([]int64, 0, len(sizes))
+	for i, key := range keys {
+		if p.evaluate(OpListObjects, key) == nil {
+			outKeys, outSizes = append(outKeys, key), append(outSizes, sizes[i])
+		}
+	}
+	outPrefixes := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if p.evaluate(OpListObjects, prefix) == nil {
+			outPrefixes = append(outPrefixes, prefix)
+		}
+	}
+	return outKeys, outSizes, outPrefixes, nil
+}
+
+func (p *PolicyS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	if err := p.check(OpPutObject, key); err != nil {
+		return err
+	}
+	return p.S3.PutObject(ctx, key, meta, body)
+}
+
+func (p *PolicyS3) DeleteObject(ctx context.Context, key string) error {
+	if err := p.check(OpDeleteObject, key); err != nil {
+		return err
+	}
+	return p.S3.DeleteObject(ctx, key)
+}
+
+var _ S3 = (*PolicyS3)(nil)
@@ -0,0 +1,88 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPolicyS3_no_rules(t *testing.T) {
+	testS3Interface(t, &PolicyS3{S3: &InMemoryS3{}})
+}
+
+func TestPolicyS3_read_only(t *testing.T) {
+	inner := &InMemoryS3{}
+	AssertEqual(t, inner.PutObject(context.Background(), "a", nil, strings.NewReader("x")), nil)
+	p := &PolicyS3{S3: inner, ReadOnly: true}
+
+	_, err := p.GetObject(context.Background(), "a", io.Discard)
+	AssertEqual(t, err, nil)
+	err = p.PutObject(context.Background(), "a", nil, strings.NewReader("y"))
+	AssertErrorIs(t, err, ErrPermissionDenied)
+	AssertErrorEqual(t, err, "permission denied: PutObject 'a': read-only")
+	var pe *PermissionError
+	AssertEqual(t, errors.As(err, &pe), true)
+	AssertEqual(t, pe.Op, OpPutObject)
+	AssertErrorIs(t, p.DeleteObject(context.Background(), "a"), ErrPermissionDenied)
+	_, _, err = inner.HeadObject(context.Background(), "a")
+	AssertEqual(t, err, nil)
+}
+
+func TestPolicyS3_rules(t *testing.T) {
+	p := &PolicyS3{S3: &InMemoryS3{}, DefaultDeny: true, Rules: []PolicyRule{
+		{Effect: PolicyDeny, Ops: []S3Operation{OpDeleteObject}},
+		{Effect: PolicyAllow, Ops: []S3Operation{OpPutObject}, Pattern: "docs/*/changes/peer-a/*"},
+		{Effect: PolicyAllow, Ops: []S3Operation{OpGetObject, OpHeadObject, OpListObjects}, KeyPrefix: "docs/"},
+	}}
+	AssertEqual(t, p.PutObject(context.Background(), "docs/1/changes/peer-a/1", nil, strings.NewReader("x")), nil)
+	AssertErrorIs(t, p.PutObject(context.Background(), "docs/1/changes/peer-b/1", nil, strings.NewReader("x")), ErrPermissionDenied)
+	AssertErrorIs(t, p.PutObject(context.Background(), "docs/1/changes/peer-a/1/x", nil, strings.NewReader("x")), ErrPermissionDenied)
+	AssertErrorEqual(t, p.DeleteObject(context.Background(), "docs/1/changes/peer-a/1"), "permission denied: DeleteObject 'docs/1/changes/peer-a/1': denied by rule 0")
+
+	_, err := p.GetObject(context.Background(), "docs/1/changes/peer-a/1", io.Discard)
+	AssertEqual(t, err, nil)
+	keys, _, _, err := p.ListObjects(context.Background(), "docs/", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, keys, []string{"docs/1/changes/peer-a/1"})
+	_, _, _, err = p.ListObjects(context.Background(), "", "")
+	AssertErrorEqual(t, err, "permission denied: ListObjects '': no rule allows it")
+}
+
+func TestPolicyS3_escape(t *testing.T) {
+	inner := &InMemoryS3{}
+	p := &PolicyS3{S3: inner, DefaultDeny: true, Rules: []PolicyRule{
+		{Effect: PolicyAllow, Ops: []S3Operation{OpPutObject, OpGetObject}, KeyPrefix: "docs/1/changes/peer-a/"},
+	}}
+	for _, key := range []string{
+		"docs/1/changes/peer-a/../../../../admin/x",
+		"docs/1/changes/peer-a/./x",
+		"docs/1/changes/peer-a//x",
+		"/docs/1/changes/peer-a/x",
+	} {
+		AssertErrorIs(t, p.PutObject(context.Background(), key, nil, strings.NewReader("x")), ErrInvalidKey)
+		_, err := p.GetObject(context.Background(), key, io.Discard)
+		AssertErrorIs(t, err, ErrInvalidKey)
+	}
+	keys, _, _, err := inner.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, keys, []string{})
+}
+
+func TestPolicyS3_list_filter(t *testing.T) {
+	inner := &InMemoryS3{}
+	for _, key := range []string{"docs/1/a", "docs/secret/b", "docs/secret/c/d"} {
+		AssertEqual(t, inner.PutObject(context.Background(), key, nil, strings.NewReader("x")), nil)
+	}
+	p := &PolicyS3{S3: inner, Rules: []PolicyRule{
+		{Effect: PolicyDeny, KeyPrefix: "docs/secret/"},
+	}}
+	keys, sizes, _, err := p.ListObjects(context.Background(), "docs/", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, keys, []string{"docs/1/a"})
+	AssertEqual(t, sizes, []int64{1})
+	_, _, prefixes, err := p.ListObjects(context.Background(), "docs/", "/")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, prefixes, []string{"docs/1/"})
+}
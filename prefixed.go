@@ -0,0 +1,79 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrInvalidKey is returned when a key tries to escape the prefix of a PrefixedS3 or the rules of a PolicyS3.
+var ErrInvalidKey = errors.New("invalid key")
+
+// PrefixedS3 scopes the underlying S3 to the keys under Prefix, which is prepended to every key as is and so should
+// usually end with "/". Keys returned by ListObjects are relative to the Prefix. Keys that are absolute or contain ".."
+// segments are rejected with ErrInvalidKey so that they can't address objects outside the Prefix, even on stores that
+// normalise paths.
+type PrefixedS3 struct {
+	S3
+	Prefix string
+}
+
+// scopedKey validates the key or list prefix and returns it with the Prefix prepended.
+func (s *PrefixedS3) scopedKey(key string) (string, error) {
+	if strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("%w: '%s' is absolute", ErrInvalidKey, key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("%w: '%s' contains '..'", ErrInvalidKey, key)
+		}
+	}
+	return s.Prefix + key, nil
+}
+
+func (s *PrefixedS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
+	if key, err = s.scopedKey(key); err != nil {
+		return nil, err
+	}
+	return s.S3.GetObject(ctx, key, dst)
+}
+
+func (s *PrefixedS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
+	if key, err = s.scopedKey(key); err != nil {
+		return 0, nil, err
+	}
+	return s.S3.HeadObject(ctx, key)
+}
+
+func (s *PrefixedS3) ListObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	if prefix, err = s.scopedKey(prefix); err != nil {
+		return nil, nil, nil, err
+	} else if keys, sizes, prefixes, err = s.S3.ListObjects(ctx, prefix, delimiter); err != nil {
+		return nil, nil, nil, err
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, s.Prefix)
+	}
+	for i, p := range prefixes {
+		prefixes[i] = strings.TrimPrefix(p, s.Prefix)
+	}
+	return keys, sizes, prefixes, nil
+}
+
+func (s *PrefixedS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	if key, err = s.scopedKey(key); err != nil {
+		return err
+	}
+	return s.S3.PutObject(ctx, key, meta, body)
+}
+
+func (s *PrefixedS3) DeleteObject(ctx context.Context, key string) (err error) {
+	if key, err = s.scopedKey(key); err != nil {
+		return err
+	}
+	return s.S3.DeleteObject(ctx, key)
+}
+
+var _ S3 = (*PrefixedS3)(nil)
@@ -0,0 +1,52 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPrefixedS3(t *testing.T) {
+	inner := &InMemoryS3{}
+	AssertEqual(t, inner.PutObject(context.Background(), "tenant-b/sample.jpg", nil, strings.NewReader("other")), nil)
+	AssertEqual(t, inner.PutObject(context.Background(), "tenant-ab/sample.jpg", nil, strings.NewReader("other")), nil)
+	testS3Interface(t, &PrefixedS3{S3: inner, Prefix: "tenant-a/"})
+
+	keys, _, _, err := inner.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, keys, []string{"tenant-ab/sample.jpg", "tenant-b/sample.jpg"})
+}
+
+func TestPrefixedS3_scoping(t *testing.T) {
+	inner := &InMemoryS3{}
+	s := &PrefixedS3{S3: inner, Prefix: "tenant-a/"}
+	AssertEqual(t, s.PutObject(context.Background(), "docs/1", nil, strings.NewReader("x")), nil)
+
+	n, _, err := inner.HeadObject(context.Background(), "tenant-a/docs/1")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, n, int64(1))
+
+	keys, _, prefixes, err := s.ListObjects(context.Background(), "", "/")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, keys, []string{})
+	AssertEqual(t, prefixes, []string{"docs/"})
+}
+
+func TestPrefixedS3_invalid_keys(t *testing.T) {
+	s := &PrefixedS3{S3: &InMemoryS3{}, Prefix: "tenant-a/"}
+	for _, key := range []string{"/docs/1", "..", "../tenant-b/docs/1", "docs/../../tenant-b", "docs/.."} {
+		t.Run(key, func(t *testing.T) {
+			_, err := s.GetObject(context.Background(), key, io.Discard)
+			AssertErrorIs(t, err, ErrInvalidKey)
+			_, _, err = s.HeadObject(context.Background(), key)
+			AssertErrorIs(t, err, ErrInvalidKey)
+			_, _, _, err = s.ListObjects(context.Background(), key, "")
+			AssertErrorIs(t, err, ErrInvalidKey)
+			AssertErrorIs(t, s.PutObject(context.Background(), key, nil, strings.NewReader("x")), ErrInvalidKey)
+			AssertErrorIs(t, s.DeleteObject(context.Background(), key), ErrInvalidKey)
+		})
+	}
+	_, _, err := s.HeadObject(context.Background(), "docs/..x")
+	AssertErrorIs(t, err, ErrObjectNotFound)
+}
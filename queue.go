@@ -0,0 +1,140 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dirQueue is a durable FIFO queue that keeps each item as a JSON file in a directory. Items are named by a
+// zero-padded sequence number so that the directory listing is in queue order. The directory is created on the first
+// push.
+type dirQueue struct {
+	dir string
+
+	mux  sync.Mutex
+	next uint64
+}
+
+const dirQueueSuffix = ".json"
+
+// dirQueueParked is the subdirectory of a queue that keeps the items taken out of it by park.
+const dirQueueParked = "parked"
+
+// errCorruptQueueItem is returned when a queued item can't be decoded.
+var errCorruptQueueItem = errors.New("failed to decode queue item")
+
+// names returns the names of the queued items in order.
+func (q *dirQueue) names() ([]string, error) {
+	return queueNames(q.dir)
+}
+
+// queueNames returns the names of the items in the directory in order.
+func queueNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list queue: %w", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") && strings.HasSuffix(e.Name(), dirQueueSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// push adds the item to the end of the queue and returns its name.
+func (q *dirQueue) push(item any) (string, error) {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode queue item: %w", err)
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if q.next == 0 {
+		if err := os.MkdirAll(q.dir, 0o700); err != nil {
+			return "", fmt.Errorf("failed to create queue: %w", err)
+		}
+		// parked items keep their names, so new items are numbered after them too
+		for _, dir := range []string{q.dir, filepath.Join(q.dir, dirQueueParked)} {
+			if names, err := queueNames(dir); err != nil {
+				return "", err
+			} else if len(names) > 0 {
+				last, _ := strconv.ParseUint(strings.TrimSuffix(names[len(names)-1], dirQueueSuffix), 10, 64)
+				q.next = max(q.next, last)
+			}
+		}
+		q.next++
+	}
+	f, err := os.CreateTemp(q.dir, ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create queue item: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	name := fmt.Sprintf("%020d%s", q.next, dirQueueSuffix)
+	if _, err := f.Write(raw); err != nil {
+		_ = f.Close()
+		return "", fmt.Errorf("failed to write queue item: %w", err)
+	} else if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return "", fmt.Errorf("failed to write queue item: %w", err)
+	} else if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to write queue item: %w", err)
+	} else if err := os.Rename(f.Name(), filepath.Join(q.dir, name)); err != nil {
+		return "", fmt.Errorf("failed to rename queue item: %w", err)
+	}
+	q.next++
+	return name, nil
+}
+
+func (q *dirQueue) read(name string, item any) error {
+	if raw, err := os.ReadFile(filepath.Join(q.dir, name)); err != nil {
+		return fmt.Errorf("failed to read queue item: %w", err)
+	} else if err := json.Unmarshal(raw, item); err != nil {
+		return fmt.Errorf("%w %s: %w", errCorruptQueueItem, name, err)
+	}
+	return nil
+}
+
+func (q *dirQueue) remove(name string) error {
+	if err := os.Remove(filepath.Join(q.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove queue item: %w", err)
+	}
+	return nil
+}
+
+// park moves the item out of the queue into the parked subdirectory, where it is kept for inspection.
+func (q *dirQueue) park(name string) error {
+	if err := os.MkdirAll(filepath.Join(q.dir, dirQueueParked), 0o700); err != nil {
+		return fmt.Errorf("failed to create parked queue: %w", err)
+	} else if err := os.Rename(filepath.Join(q.dir, name), filepath.Join(q.dir, dirQueueParked, name)); err != nil {
+		return fmt.Errorf("failed to park queue item: %w", err)
+	}
+	return nil
+}
+
+// runReplay calls replay every interval until the context is cancelled, for the RunReplay methods of the stores that
+// queue writes. Failures are retried on the next interval.
+func runReplay(ctx context.Context, interval time.Duration, replay func(ctx context.Context) (int, error)) error {
+	for {
+		_, _ = replay(ctx)
+		if err := sleepContext(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDocumentNotFound is returned when opening a document that hasn't been created.
+	ErrDocumentNotFound = errors.New("document not found")
+	// ErrDocumentExists is returned when creating a document that already exists.
+	ErrDocumentExists = errors.New("document already exists")
+)
+
+// errManifestsUnsupported is returned by the manifest methods of a Document when the backend can't store manifests.
+var errManifestsUnsupported = errors.New("manifests require a backend that supports conditional writes and etags")
+
+// DefaultRepoListInterval is how often Sync lists the change logs of a document that has a manifest, for a Repo with
+// no ListInterval.
+const DefaultRepoListInterval = time.Minute
+
+// DefaultRepoSyncConcurrency is the number of documents synced at once by a Repo with no MaxConcurrency.
+const DefaultRepoSyncConcurrency = 4
+
+// documentMarkerKey returns the key of the object that records that a document exists.
+func documentMarkerKey(documentId string) string {
+	return DocumentPrefix(documentId) + "document"
+}
+
+// isChangeKey is the CachingS3 immutability policy for repos, change objects are never rewritten.
+func isChangeKey(key string) bool {
+	_, _, _, err := ParseChangeKey(key)
+	return err == nil
+}
+
+// conditionalS3 is a store that supports conditional writes and etags.
+type conditionalS3 interface {
+	S3
+	ETagGetter
+	ConditionalPutter
+}
+
+// RepoOptions configure the shared stack that a Repo builds over its backend.
+type RepoOptions struct {
+	// PeerId identifies this client in the change logs of the documents.
+	PeerId string
+	// Cache, when set, caches the immutable change objects.
+	Cache CacheStore
+	// Reads, Writes, Lists and MaxInFlight limit the requests to the backend, see ThrottledS3.
+	Reads       RateLimit
+	Writes      RateLimit
+	Lists       RateLimit
+	MaxInFlight int
+	// MaxConcurrency is the number of documents synced at once by SyncAll, DefaultRepoSyncConcurrency when zero.
+	MaxConcurrency int
+	// ListInterval is how often Sync also lists the change logs of a document that has a manifest, to find changes
+	// whose manifest update never happened. DefaultRepoListInterval when zero.
+	ListInterval time.Duration
+}
+
+// Repo manages a set of documents stored in one backend. All of its documents share the same rate limits and cache.
+//
+// When the backend implements ConditionalPutter and ETagGetter, documents and changes are created with conditional
+// writes so that two peers can't both create the same document or change, and each document also keeps a Manifest
+// that is advanced on every Append. Sync reads it to download the new changes, starting from its snapshot when it is
+// behind, and only lists the change logs on the first Sync and then every ListInterval.
+type Repo struct {
+	s3 S3
+	// conditional is the throttled backend if it supports conditional writes and etags, otherwise nil.
+	conditional    conditionalS3
+	peerId         string
+	maxConcurrency int
+	listInterval   time.Duration
+
+	mux  sync.Mutex
+	open map[string]*Document
+}
+
+func NewRepo(backend S3, options RepoOptions) (*Repo, error) {
+	if err := validateKeySegment("peer", options.PeerId); err != nil {
+		return nil, err
+	}
+	throttled := withConditionalWrites(&ThrottledS3{
+		S3: backend, Reads: options.Reads, Writes: options.Writes, Lists: options.Lists, MaxInFlight: options.MaxInFlight,
+	})
+	conditional, _ := throttled.(conditionalS3)
+	s3 := throttled
+	if options.Cache != nil {
+		s3 = &CachingS3{S3: s3, Store: options.Cache, Immutable: isChangeKey}
+	}
+	maxConcurrency := options.MaxConcurrency
+	if maxConcurrency <= 0 {
+		maxConcurrency = DefaultRepoSyncConcurrency
+	}
+	listInterval := options.ListInterval
+	if listInterval <= 0 {
+		listInterval = DefaultRepoListInterval
+	}
+	return &Repo{
+		s3: s3, conditional: conditional, peerId: options.PeerId, maxConcurrency: maxConcurrency, listInterval: listInterval,
+		open: make(map[string]*Document),
+	}, nil
+}
+
+func (r *Repo) document(documentId string) *Document {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if doc, ok := r.open[documentId]; ok {
+		return doc
+	}
+	doc := &Document{Id: documentId, repo: r, changeLog: &ChangeLog{S3: r.s3, DocumentId: documentId}, seen: make(map[string]uint64)}
+	r.open[documentId] = doc
+	return doc
+}
+
+// Create creates a new document, returning ErrDocumentExists if it already exists.
+func (r *Repo) Create(ctx context.Context, documentId string) (*Document, error) {
+	if err := validateKeySegment("document", documentId); err != nil {
+		return nil, err
+	}
+	meta := map[string]string{"created-by": r.peerId, "created-at": time.Now().UTC().Format(time.RFC3339)}
+	if r.conditional != nil {
+		if _, err := r.conditional.PutObjectIf(ctx, documentMarkerKey(documentId), meta, bytes.NewReader(nil), PutCondition{IfNoneMatch: true}); errors.Is(err, ErrPreconditionFailed) {
+			return nil, fmt.Errorf("%w: %s", ErrDocumentExists, documentId)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to create document: %w", err)
+		}
+		return r.document(documentId), nil
+	}
+	if _, _, err := r.s3.HeadObject(ctx, documentMarkerKey(documentId)); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDocumentExists, documentId)
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		return nil, fmt.Errorf("failed to check for existing document: %w", err)
+	}
+	if err := r.s3.PutObject(ctx, documentMarkerKey(documentId), meta, bytes.NewReader(nil)); err != nil {
+		return nil, fmt.Errorf("failed to create document: %w", err)
+	}
+	return r.document(documentId), nil
+}
+
+// Open returns an existing document, returning ErrDocumentNotFound if it hasn't been created. Opening a document
+// again returns the same *Document.
+func (r *Repo) Open(ctx context.Context, documentId string) (*Document, error) {
+	if err := validateKeySegment("document", documentId); err != nil {
+		return nil, err
+	}
+	if _, _, err := r.s3.HeadObject(ctx, documentMarkerKey(documentId)); errors.Is(err, ErrObjectNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrDocumentNotFound, documentId)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open document: %w", err)
+	}
+	return r.document(documentId), nil
+}
+
+// List returns the ids of all the documents in the backend.
+func (r *Repo) List(ctx context.Context) ([]string, error) {
+	_, _, prefixes, err := r.s3.ListObjects(ctx, documentsPrefix, "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list documents: %w", err)
+	}
+	ids := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(p, documentsPrefix), "/"))
+	}
+	return ids, nil
+}
+
+// Delete deletes the document and all of its objects. The marker is deleted first so that the document can't be
+// opened while the rest of its objects are deleted.
+func (r *Repo) Delete(ctx context.Context, documentId string) error {
+	if err := validateKeySegment("document", documentId); err != nil {
+		return err
+	}
+	r.mux.Lock()
+	delete(r.open, documentId)
+	r.mux.Unlock()
+	if err := r.s3.DeleteObject(ctx, documentMarkerKey(documentId)); err != nil {
+		return fmt.Errorf("failed to delete document: %w", err)
+	}
+	keys, _, _, err := r.s3.ListObjects(ctx, DocumentPrefix(documentId), "")
+	if err != nil {
+		return fmt.Errorf("failed to list document objects: %w", err)
+	}
+	for _, key := range keys {
+		if err := r.s3.DeleteObject(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete '%s': %w", key, err)
+		}
+	}
+	return nil
+}
+
+// SyncAll syncs every open document, at most MaxConcurrency at a time, and returns the new changes by document id.
+// Documents that fail to sync are reported in the joined error while the others are still returned.
+func (r *Repo) SyncAll(ctx context.Context) (map[string][]Change, error) {
+	r.mux.Lock()
+	docs := make([]*Document, 0, len(r.open))
+	for _, doc := range r.open {
+		docs = append(docs, doc)
+	}
+	r.mux.Unlock()
+
+	var mux sync.Mutex
+	out := make(map[string][]Change, len(docs))
+	var errs []error
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, r.maxConcurrency)
+	for _, doc := range docs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return out, errors.Join(append(errs, ctx.Err())...)
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			changes, err := doc.Sync(ctx)
+			mux.Lock()
+			defer mux.Unlock()
+			if len(changes) > 0 {
+				out[doc.Id] = changes
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to sync document '%s': %w", doc.Id, err))
+			}
+		}()
+	}
+	wg.Wait()
+	return out, errors.Join(errs...)
+}
+
+// Change is a change downloaded from a document's change log. When Snapshot is set it is instead the snapshot of the
+// document from its manifest, whose Key is the snapshot key, and which contains the changes it covers.
+type Change struct {
+	ChangeRef
+	Meta     map[string]string
+	Data     []byte
+	Snapshot bool
+}
+
+// Document is a document in a Repo. It tracks the changes that have been synced and the local sequence number.
+type Document struct {
+	Id        string
+	repo      *Repo
+	changeLog *ChangeLog
+
+	mux        sync.Mutex
+	seen       map[string]uint64
+	nextSeq    uint64
+	lastListed time.Time
+}
+
+// Append adds a change from this peer to the document and advances the peer's mark in the manifest. If updating the
+// manifest fails the change has still been written. The manifest catches up on the next successful Append, and until
+// then readers find the change when they next list the change logs.
+func (d *Document) Append(ctx context.Context, meta map[string]string, body io.Reader) (ChangeRef, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.nextSeq == 0 {
+		keys, _, _, err := d.repo.s3.ListObjects(ctx, ChangesPrefix(d.Id)+d.repo.peerId+"/", "")
+		if err != nil {
+			return ChangeRef{}, fmt.Errorf("failed to list own changes: %w", err)
+		}
+		d.nextSeq = 1
+		for _, key := range keys {
+			if _, _, seq, err := ParseChangeKey(key); err == nil {
+				d.nextSeq = max(d.nextSeq, seq+1)
+			}
+		}
+	}
+	// the cache hides conditional writes, so the change is written straight to the throttled backend when it has them
+	changeLog := d.changeLog
+	if d.repo.conditional != nil {
+		changeLog = &ChangeLog{S3: d.repo.conditional, DocumentId: d.Id}
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return ChangeRef{}, fmt.Errorf("failed to buffer data: %w", err)
+	} else if err := changeLog.Append(ctx, d.repo.peerId, d.nextSeq, meta, bytes.NewReader(data)); err != nil {
+		// the change may have been written despite the error, so the next Append lists the sequence again
+		d.nextSeq = 0
+		return ChangeRef{}, err
+	}
+	ref := ChangeRef{Peer: d.repo.peerId, Seq: d.nextSeq, Key: ChangeKey(d.Id, d.repo.peerId, d.nextSeq), Size: int64(len(data))}
+	d.nextSeq++
+	// our own changes don't need to be downloaded again, unless there are earlier ones we haven't seen yet
+	if d.seen[ref.Peer] == ref.Seq-1 {
+		d.seen[ref.Peer] = ref.Seq
+	}
+	if d.repo.conditional != nil {
+		if _, err := UpdateManifest(ctx, d.repo.conditional, d.Id, func(m *Manifest) error {
+			m.Advance(ref.Peer, ref.Seq)
+			return nil
+		}); err != nil {
+			return ref, err
+		}
+	}
+	return ref, nil
+}
+
+// Manifest returns the manifest of the document, or ErrObjectNotFound if it has none yet.
+func (d *Document) Manifest(ctx context.Context) (*Manifest, error) {
+	if d.repo.conditional == nil {
+		return nil, errManifestsUnsupported
+	}
+	m, _, err := ReadManifest(ctx, d.repo.conditional, d.Id)
+	return m, err
+}
+
+// UpdateManifest applies the update to the manifest of the document, see UpdateManifest. This is how the heads and
+// snapshot are recorded.
+func (d *Document) UpdateManifest(ctx context.Context, update func(m *Manifest) error) (*Manifest, error) {
+	if d.repo.conditional == nil {
+		return nil, errManifestsUnsupported
+	}
+	return UpdateManifest(ctx, d.repo.conditional, d.Id, update)
+}
+
+// pending returns the snapshot to load, if the document is behind it, and the changes that haven't been synced yet
+// after it. The manifest marks are a lower bound, so the change logs are also listed on the first Sync and then every
+// ListInterval, or whenever the document has no manifest.
+func (d *Document) pending(ctx context.Context) (snapshot *Manifest, refs []ChangeRef, err error) {
+	var m *Manifest
+	if d.repo.conditional != nil {
+		if m, _, err = ReadManifest(ctx, d.repo.conditional, d.Id); errors.Is(err, ErrObjectNotFound) {
+			m = nil
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to read manifest: %w", err)
+		}
+	}
+	seen := d.seen
+	if m != nil {
+		behind := false
+		for peer, seq := range m.SnapshotCovers {
+			behind = behind || d.seen[peer] < seq
+		}
+		if m.Snapshot != "" && behind {
+			snapshot, seen = m, maps.Clone(d.seen)
+			for peer, seq := range m.SnapshotCovers {
+				seen[peer] = max(seen[peer], seq)
+			}
+		}
+		refs = m.Missing(d.Id, seen)
+		if !d.lastListed.IsZero() && time.Since(d.lastListed) < d.repo.listInterval {
+			return snapshot, refs, nil
+		}
+	}
+	listed, err := d.changeLog.Changes(ctx, HighWaterMarks(seen, refs))
+	if err == nil || errors.Is(err, ErrChangeGap) || errors.Is(err, ErrDuplicateChange) {
+		d.lastListed = time.Now()
+	}
+	return snapshot, append(refs, listed...), err
+}
+
+// Sync downloads the changes from the document's change log that haven't been synced before. If the document's
+// manifest has a snapshot that covers changes this document hasn't seen, the snapshot is downloaded first and returned
+// as a Change with Snapshot set, and the changes it covers are skipped.
+func (d *Document) Sync(ctx context.Context) ([]Change, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	snapshot, refs, listErr := d.pending(ctx)
+	if listErr != nil && !errors.Is(listErr, ErrChangeGap) && !errors.Is(listErr, ErrDuplicateChange) {
+		return nil, listErr
+	}
+	changes := make([]Change, 0, len(refs)+1)
+	if snapshot != nil {
+		buff := new(bytes.Buffer)
+		meta, err := d.repo.s3.GetObject(ctx, snapshot.Snapshot, buff)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download snapshot '%s': %w", snapshot.Snapshot, err)
+		}
+		ref := ChangeRef{Key: snapshot.Snapshot, Size: int64(buff.Len())}
+		changes = append(changes, Change{ChangeRef: ref, Meta: meta, Data: buff.Bytes(), Snapshot: true})
+		for peer, seq := range snapshot.SnapshotCovers {
+			d.seen[peer] = max(d.seen[peer], seq)
+		}
+	}
+	for _, ref := range refs {
+		if d.seen[ref.Peer] >= ref.Seq {
+			continue
+		}
+		buff := new(bytes.Buffer)
+		meta, err := d.repo.s3.GetObject(ctx, ref.Key, buff)
+		if errors.Is(err, ErrObjectNotFound) {
+			return changes, fmt.Errorf("%w: change '%s' doesn't exist", ErrChangeGap, ref.Key)
+		} else if err != nil {
+			return changes, fmt.Errorf("failed to download change '%s': %w", ref.Key, err)
+		}
+		ref.Size = int64(buff.Len())
+		changes = append(changes, Change{ChangeRef: ref, Meta: meta, Data: buff.Bytes()})
+		d.seen[ref.Peer] = ref.Seq
+	}
+	return changes, listErr
+}
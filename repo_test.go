@@ -0,0 +1,275 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepo(t *testing.T) {
+	backend := &InMemoryS3{}
+	a, err := NewRepo(backend, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	b, err := NewRepo(backend, RepoOptions{PeerId: "peer-b", Cache: NewLRUCacheStore(1 << 20)})
+	MustAssertEqual(t, err, nil)
+
+	docA, err := a.Create(context.Background(), "doc-1")
+	AssertEqual(t, err, nil)
+	_, err = a.Create(context.Background(), "doc-1")
+	AssertErrorIs(t, err, ErrDocumentExists)
+	_, err = b.Open(context.Background(), "doc-2")
+	AssertErrorIs(t, err, ErrDocumentNotFound)
+	docB, err := b.Open(context.Background(), "doc-1")
+	AssertEqual(t, err, nil)
+
+	ref, err := docA.Append(context.Background(), nil, strings.NewReader("first"))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, ref.Seq, uint64(1))
+	_, err = docB.Append(context.Background(), nil, strings.NewReader("second"))
+	AssertEqual(t, err, nil)
+
+	changes, err := a.SyncAll(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(changes["doc-1"]), 1)
+	AssertEqual(t, string(changes["doc-1"][0].Data), "second")
+	changes, err = b.SyncAll(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(changes["doc-1"]), 1)
+	AssertEqual(t, string(changes["doc-1"][0].Data), "first")
+	changes, err = b.SyncAll(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(changes), 0)
+
+	// a new repo for the same peer continues its sequence
+	a2, err := NewRepo(backend, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	docA2, err := a2.Open(context.Background(), "doc-1")
+	AssertEqual(t, err, nil)
+	ref, err = docA2.Append(context.Background(), nil, strings.NewReader("third"))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, ref.Seq, uint64(2))
+
+	ids, err := a.List(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, ids, []string{"doc-1"})
+	AssertEqual(t, a.Delete(context.Background(), "doc-1"), nil)
+	keys, _, _, err := backend.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, keys, []string{})
+}
+
+func TestRepo_manifest(t *testing.T) {
+	backend := newCountingS3()
+	a, err := NewRepo(backend, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	b, err := NewRepo(backend, RepoOptions{PeerId: "peer-b"})
+	MustAssertEqual(t, err, nil)
+	docA, err := a.Create(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+	docB, err := b.Open(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+
+	for _, data := range []string{"one", "two"} {
+		_, err := docA.Append(context.Background(), nil, strings.NewReader(data))
+		AssertEqual(t, err, nil)
+	}
+	m, err := docA.UpdateManifest(context.Background(), func(m *Manifest) error {
+		m.Heads = []string{"abc"}
+		return nil
+	})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, m.Peers, map[string]uint64{"peer-a": 2})
+
+	changes, err := docB.Sync(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(changes), 2)
+	AssertEqual(t, changes[1].Key, ChangeKey("doc-1", "peer-a", 2))
+	AssertEqual(t, changes[1].Size, int64(3))
+
+	// later syncs within the list interval only read the manifest and the new changes
+	_, err = docA.Append(context.Background(), nil, strings.NewReader("three"))
+	AssertEqual(t, err, nil)
+	backend.counts = make(map[S3Operation]int)
+	changes, err = docB.Sync(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(changes), 1)
+	AssertEqual(t, backend.counts[OpListObjects], 0)
+	AssertEqual(t, backend.counts[OpGetObject], 2)
+
+	m, err = docB.Manifest(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, m.Heads, []string{"abc"})
+
+	// a change missing from the log is reported as a gap
+	AssertEqual(t, backend.DeleteObject(context.Background(), ChangeKey("doc-1", "peer-a", 1)), nil)
+	c, err := NewRepo(backend, RepoOptions{PeerId: "peer-c"})
+	MustAssertEqual(t, err, nil)
+	docC, err := c.Open(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+	_, err = docC.Sync(context.Background())
+	AssertErrorIs(t, err, ErrChangeGap)
+}
+
+func TestRepo_manifest_update_lost(t *testing.T) {
+	backend := &InMemoryS3{}
+	a, err := NewRepo(backend, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	b, err := NewRepo(backend, RepoOptions{PeerId: "peer-b", ListInterval: time.Nanosecond})
+	MustAssertEqual(t, err, nil)
+	docA, err := a.Create(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+	docB, err := b.Open(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+	_, err = docA.Append(context.Background(), nil, strings.NewReader("one"))
+	AssertEqual(t, err, nil)
+	changes, err := docB.Sync(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(changes), 1)
+
+	// peer-c crashes between writing a change and updating the manifest
+	log := &ChangeLog{S3: backend, DocumentId: "doc-1"}
+	AssertEqual(t, log.Append(context.Background(), "peer-c", 1, nil, strings.NewReader("orphan")), nil)
+	time.Sleep(time.Millisecond)
+	changes, err = docB.Sync(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(changes), 1)
+	AssertEqual(t, changes[0].Key, ChangeKey("doc-1", "peer-c", 1))
+	AssertEqual(t, string(changes[0].Data), "orphan")
+}
+
+func TestRepo_manifest_snapshot(t *testing.T) {
+	backend := &InMemoryS3{}
+	a, err := NewRepo(backend, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	docA, err := a.Create(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+	for _, data := range []string{"one", "two", "three"} {
+		_, err := docA.Append(context.Background(), nil, strings.NewReader(data))
+		AssertEqual(t, err, nil)
+	}
+
+	// compaction writes a snapshot covering the first two changes and deletes them
+	snapshotKey := DocumentPrefix("doc-1") + "snapshots/1"
+	AssertEqual(t, backend.PutObject(context.Background(), snapshotKey, nil, strings.NewReader("one+two")), nil)
+	_, err = docA.UpdateManifest(context.Background(), func(m *Manifest) error {
+		m.Snapshot, m.SnapshotCovers = snapshotKey, map[string]uint64{"peer-a": 2}
+		return nil
+	})
+	AssertEqual(t, err, nil)
+	for seq := range uint64(2) {
+		AssertEqual(t, backend.DeleteObject(context.Background(), ChangeKey("doc-1", "peer-a", seq+1)), nil)
+	}
+
+	b, err := NewRepo(backend, RepoOptions{PeerId: "peer-b"})
+	MustAssertEqual(t, err, nil)
+	docB, err := b.Open(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+	changes, err := docB.Sync(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(changes), 2)
+	AssertEqual(t, changes[0].Snapshot, true)
+	AssertEqual(t, changes[0].Key, snapshotKey)
+	AssertEqual(t, string(changes[0].Data), "one+two")
+	AssertEqual(t, changes[1].Seq, uint64(3))
+
+	// a reader that is already past the snapshot doesn't load it again
+	_, err = docA.Append(context.Background(), nil, strings.NewReader("four"))
+	AssertEqual(t, err, nil)
+	changes, err = docB.Sync(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(changes), 1)
+	AssertEqual(t, changes[0].Seq, uint64(4))
+}
+
+func TestRepo_without_manifests(t *testing.T) {
+	r, err := NewRepo(&ClientEncryptedS3{S3: &InMemoryS3{}, BlockCipher: newTestBlockCipher(t)}, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	doc, err := r.Create(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+	_, err = doc.Append(context.Background(), nil, strings.NewReader("one"))
+	AssertEqual(t, err, nil)
+	_, err = doc.Manifest(context.Background())
+	AssertErrorEqual(t, err, "manifests require a backend that supports conditional writes and etags")
+}
+
+func TestDocument_Append_dropped_put(t *testing.T) {
+	backend := &FaultyS3{S3: &InMemoryS3{}, Rules: []*FaultRule{
+		{Kind: FaultDroppedPut, KeyPrefix: ChangesPrefix("doc-1"), Times: 1},
+	}}
+	r, err := NewRepo(backend, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	doc, err := r.Create(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+
+	// the change lands but the caller sees an error, so the sequence is listed again
+	_, err = doc.Append(context.Background(), nil, strings.NewReader("one"))
+	AssertErrorIs(t, err, ErrInjectedFault)
+	ref, err := doc.Append(context.Background(), nil, strings.NewReader("two"))
+	AssertEqual(t, err, nil)
+	AssertEqual(t, ref.Seq, uint64(2))
+}
+
+// staleHeadS3 never sees existing objects in HeadObject, like a peer racing to create the same document.
+type staleHeadS3 struct {
+	*InMemoryS3
+}
+
+func (s *staleHeadS3) HeadObject(ctx context.Context, key string) (int64, map[string]string, error) {
+	return 0, nil, ErrObjectNotFound
+}
+
+func TestRepo_Create_race(t *testing.T) {
+	backend := &staleHeadS3{InMemoryS3: &InMemoryS3{}}
+	a, err := NewRepo(backend, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	b, err := NewRepo(backend, RepoOptions{PeerId: "peer-b"})
+	MustAssertEqual(t, err, nil)
+	_, err = a.Create(context.Background(), "doc-1")
+	AssertEqual(t, err, nil)
+	_, err = b.Create(context.Background(), "doc-1")
+	AssertErrorIs(t, err, ErrDocumentExists)
+}
+
+func TestRepo_Append_race(t *testing.T) {
+	backend := &InMemoryS3{}
+	a, err := NewRepo(&staleHeadS3{InMemoryS3: backend}, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	b, err := NewRepo(backend, RepoOptions{PeerId: "peer-a"})
+	MustAssertEqual(t, err, nil)
+	docA, err := a.Create(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+	docB, err := b.Open(context.Background(), "doc-1")
+	MustAssertEqual(t, err, nil)
+
+	// both processes of the peer pick the second sequence number, and the conditional write stops the later one
+	_, err = docA.Append(context.Background(), nil, strings.NewReader("one"))
+	AssertEqual(t, err, nil)
+	_, err = docB.Append(context.Background(), nil, strings.NewReader("two"))
+	AssertEqual(t, err, nil)
+	_, err = docA.Append(context.Background(), nil, strings.NewReader("three"))
+	AssertErrorIs(t, err, ErrChangeExists)
+	buff := new(strings.Builder)
+	_, err = backend.GetObject(context.Background(), ChangeKey("doc-1", "peer-a", 2), buff)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, buff.String(), "two")
+}
+
+func TestRepo_sync_concurrency(t *testing.T) {
+	backend := &concurrencyS3{S3: &InMemoryS3{}}
+	r, err := NewRepo(backend, RepoOptions{PeerId: "peer-a", MaxConcurrency: 2})
+	MustAssertEqual(t, err, nil)
+	for i := range 8 {
+		_, err := r.Create(context.Background(), fmt.Sprint("doc-", i))
+		AssertEqual(t, err, nil)
+	}
+	_, err = r.SyncAll(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, backend.highest.Load(), int64(2))
+}
+
+func TestNewRepo_invalid_peer(t *testing.T) {
+	_, err := NewRepo(&InMemoryS3{}, RepoOptions{PeerId: "a/b"})
+	AssertErrorIs(t, err, ErrInvalidKey)
+}
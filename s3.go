@@ -3,10 +3,10 @@ package automerge_s3_sync
 import (
 	"bytes"
 	"context"
-	"crypto/cipher"
 	"crypto/md5"
-	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -16,8 +16,10 @@ import (
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type S3 interface {
@@ -30,23 +32,105 @@ type S3 interface {
 
 var ErrObjectNotFound = errors.New("object not found")
 
+// ErrSlowDown indicates that the storage provider asked us to reduce the request rate (503 SlowDown).
+var ErrSlowDown = errors.New("slow down")
+
+// ErrChecksumMismatch is returned when a downloaded object doesn't match its SHA-256 checksum. The corrupt data may
+// already have been written to the destination.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrInvalidRange is returned when a requested byte range does not overlap the object.
+var ErrInvalidRange = errors.New("invalid range")
+
+// RangeGetter is an optional extension of S3 for backends that can read part of an object. A length <= 0 reads until
+// the end of the object.
+type RangeGetter interface {
+	GetObjectRange(ctx context.Context, key string, offset, length int64, dst io.Writer) (meta map[string]string, err error)
+}
+
+// ETagGetter is implemented by stores that can return the entity tag of an object, which changes whenever the object
+// is rewritten.
+type ETagGetter interface {
+	GetObjectETag(ctx context.Context, key string, dst io.Writer) (etag string, meta map[string]string, err error)
+	HeadObjectETag(ctx context.Context, key string) (size int64, etag string, meta map[string]string, err error)
+}
+
+// StartAfterLister is implemented by stores that can list only the objects with keys after startAfter, like the
+// start-after parameter of ListObjectsV2.
+type StartAfterLister interface {
+	ListObjectsAfter(ctx context.Context, prefix, delimiter, startAfter string) (keys []string, sizes []int64, prefixes []string, err error)
+}
+
+// listObjectsAfter lists the objects after startAfter, filtering the keys of the full listing if the store isn't a
+// StartAfterLister.
+func listObjectsAfter(ctx context.Context, s3 S3, prefix, delimiter, startAfter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	if lister, ok := s3.(StartAfterLister); ok {
+		return lister.ListObjectsAfter(ctx, prefix, delimiter, startAfter)
+	}
+	if keys, sizes, prefixes, err = s3.ListObjects(ctx, prefix, delimiter); err != nil {
+		return nil, nil, nil, err
+	}
+	i := sort.SearchStrings(keys, startAfter)
+	if i < len(keys) && keys[i] == startAfter {
+		i++
+	}
+	return keys[i:], sizes[i:], prefixes, nil
+}
+
+// ErrPreconditionFailed is returned when the condition of a conditional write doesn't hold.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// PutCondition is the precondition of a conditional write. The zero value is unconditional.
+type PutCondition struct {
+	// IfNoneMatch only writes the object if it doesn't exist yet.
+	IfNoneMatch bool
+	// IfMatch only writes the object if its current ETag is this one.
+	IfMatch string
+}
+
+// ConditionalPutter is implemented by stores that support conditional writes. PutObjectIf returns
+// ErrPreconditionFailed if the condition doesn't hold, and otherwise the ETag of the written object.
+type ConditionalPutter interface {
+	PutObjectIf(ctx context.Context, key string, meta map[string]string, body io.Reader, cond PutCondition) (etag string, err error)
+}
+
+// S3Operation names one of the methods on the S3 interface.
+type S3Operation string
+
+const (
+	OpGetObject    S3Operation = "GetObject"
+	OpHeadObject   S3Operation = "HeadObject"
+	OpListObjects  S3Operation = "ListObjects"
+	OpPutObject    S3Operation = "PutObject"
+	OpDeleteObject S3Operation = "DeleteObject"
+)
+
 type InMemoryS3 struct {
+	// Eventual enables simulation of list-after-write lag when set. It must be set before the first operation.
+	Eventual *EventualConsistency
+
 	mux     sync.RWMutex
 	objects map[string][]byte
 	metas   map[string]map[string]string
+
+	// state used only when Eventual is set
+	ops            int
+	pending        []pendingVisibility
+	visibleObjects map[string][]byte
+	visibleMetas   map[string]map[string]string
 }
 
 func (i *InMemoryS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	i.mux.RLock()
-	defer i.mux.RUnlock()
-	meta = maps.Clone(i.metas[key])
+	defer i.lockForRead()()
+	objects, metas := i.readView()
+	meta = maps.Clone(metas[key])
 	if meta == nil {
 		meta = map[string]string{}
 	}
-	if obj, ok := i.objects[key]; !ok {
+	if obj, ok := objects[key]; !ok {
 		return nil, ErrObjectNotFound
 	} else if _, err := dst.Write(obj); err != nil {
 		return meta, err
@@ -54,23 +138,91 @@ func (i *InMemoryS3) GetObject(ctx context.Context, key string, dst io.Writer) (
 	return meta, nil
 }
 
+func (i *InMemoryS3) GetObjectRange(ctx context.Context, key string, offset, length int64, dst io.Writer) (meta map[string]string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer i.lockForRead()()
+	objects, metas := i.readView()
+	obj, ok := objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	} else if offset < 0 || offset >= int64(len(obj)) {
+		return nil, fmt.Errorf("%w: offset %d of object with size %d", ErrInvalidRange, offset, len(obj))
+	}
+	end := int64(len(obj))
+	if length > 0 && offset+length < end {
+		end = offset + length
+	}
+	meta = maps.Clone(metas[key])
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	if _, err := dst.Write(obj[offset:end]); err != nil {
+		return meta, err
+	}
+	return meta, nil
+}
+
 func (i *InMemoryS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
 	if err := ctx.Err(); err != nil {
 		return 0, nil, err
 	}
-	i.mux.RLock()
-	defer i.mux.RUnlock()
-	meta = maps.Clone(i.metas[key])
+	defer i.lockForRead()()
+	objects, metas := i.readView()
+	meta = maps.Clone(metas[key])
 	if meta == nil {
 		meta = map[string]string{}
 	}
-	if obj, ok := i.objects[key]; !ok {
+	if obj, ok := objects[key]; !ok {
 		return 0, nil, ErrObjectNotFound
 	} else {
 		return int64(len(obj)), meta, nil
 	}
 }
 
+// etagOf returns the quoted hex md5 of the object like S3 does for objects that weren't uploaded in parts.
+func etagOf(obj []byte) string {
+	sum := md5.Sum(obj)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (i *InMemoryS3) GetObjectETag(ctx context.Context, key string, dst io.Writer) (etag string, meta map[string]string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	defer i.lockForRead()()
+	objects, metas := i.readView()
+	meta = maps.Clone(metas[key])
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	if obj, ok := objects[key]; !ok {
+		return "", nil, ErrObjectNotFound
+	} else if _, err := dst.Write(obj); err != nil {
+		return "", meta, err
+	} else {
+		return etagOf(obj), meta, nil
+	}
+}
+
+func (i *InMemoryS3) HeadObjectETag(ctx context.Context, key string) (size int64, etag string, meta map[string]string, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, "", nil, err
+	}
+	defer i.lockForRead()()
+	objects, metas := i.readView()
+	meta = maps.Clone(metas[key])
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	if obj, ok := objects[key]; !ok {
+		return 0, "", nil, ErrObjectNotFound
+	} else {
+		return int64(len(obj)), etagOf(obj), meta, nil
+	}
+}
+
 type twoSliceSorter struct {
 	keySlice  []string
 	sizeSlice []int64
@@ -92,18 +244,22 @@ func (t *twoSliceSorter) Swap(i, j int) {
 var _ sort.Interface = (*twoSliceSorter)(nil)
 
 func (i *InMemoryS3) ListObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	return i.ListObjectsAfter(ctx, prefix, delimiter, "")
+}
+
+func (i *InMemoryS3) ListObjectsAfter(ctx context.Context, prefix, delimiter, startAfter string) (keys []string, sizes []int64, prefixes []string, err error) {
 	if err := ctx.Err(); err != nil {
 		return nil, nil, nil, err
 	}
-	i.mux.RLock()
-	defer i.mux.RUnlock()
+	defer i.lockForRead()()
+	objects, _ := i.listView()
 
-	keys = make([]string, 0, len(i.objects))
-	sizes = make([]int64, 0, len(i.objects))
+	keys = make([]string, 0, len(objects))
+	sizes = make([]int64, 0, len(objects))
 	prefixSet := make(map[string]bool)
 
-	for key, obj := range i.objects {
-		if !strings.HasPrefix(key, prefix) {
+	for key, obj := range objects {
+		if !strings.HasPrefix(key, prefix) || key <= startAfter {
 			continue
 		}
 		if delimiter != "" {
@@ -127,14 +283,26 @@ func (i *InMemoryS3) ListObjects(ctx context.Context, prefix string, delimiter s
 }
 
 func (i *InMemoryS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	_, err = i.PutObjectIf(ctx, key, meta, body, PutCondition{})
+	return err
+}
+
+// PutObjectIf checks the condition against the latest state of the object, even with Eventual set, like S3 does.
+func (i *InMemoryS3) PutObjectIf(ctx context.Context, key string, meta map[string]string, body io.Reader, cond PutCondition) (etag string, err error) {
 	if err := ctx.Err(); err != nil {
-		return err
+		return "", err
 	}
 	i.mux.Lock()
 	defer i.mux.Unlock()
+	i.tick()
 	raw, err := io.ReadAll(body)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if current, ok := i.objects[key]; cond.IfNoneMatch && ok {
+		return "", fmt.Errorf("%w: '%s' already exists", ErrPreconditionFailed, key)
+	} else if cond.IfMatch != "" && (!ok || etagOf(current) != cond.IfMatch) {
+		return "", fmt.Errorf("%w: '%s' does not match %s", ErrPreconditionFailed, key, cond.IfMatch)
 	}
 	if i.objects == nil {
 		i.objects = make(map[string][]byte)
@@ -142,7 +310,8 @@ func (i *InMemoryS3) PutObject(ctx context.Context, key string, meta map[string]
 	}
 	i.objects[key] = bytes.Clone(raw)
 	i.metas[key] = maps.Clone(meta)
-	return nil
+	i.recordChange(key, false)
+	return etagOf(raw), nil
 }
 
 func (i *InMemoryS3) DeleteObject(ctx context.Context, key string) error {
@@ -151,11 +320,17 @@ func (i *InMemoryS3) DeleteObject(ctx context.Context, key string) error {
 	}
 	i.mux.Lock()
 	defer i.mux.Unlock()
+	i.tick()
 	delete(i.objects, key)
+	i.recordChange(key, true)
 	return nil
 }
 
 var _ S3 = (*InMemoryS3)(nil)
+var _ RangeGetter = (*InMemoryS3)(nil)
+var _ ETagGetter = (*InMemoryS3)(nil)
+var _ StartAfterLister = (*InMemoryS3)(nil)
+var _ ConditionalPutter = (*InMemoryS3)(nil)
 
 type HttpDoer interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -190,34 +365,33 @@ func (h *hashWriter) Write(p []byte) (n int, err error) {
 
 var _ io.Writer = (*hashWriter)(nil)
 
-func (s *S3Impl) readBlob(ctx context.Context, key, method string, dst io.Writer) (size int64, meta map[string]string, err error) {
-	if r, err := http.NewRequestWithContext(ctx, method, s.bucketUrl.ResolveReference(&url.URL{Path: key}).String(), nil); err != nil {
-		return size, meta, fmt.Errorf("failed to build request: %w", err)
-	} else if resp, err := s.client.Do(r); err != nil {
-		return size, meta, fmt.Errorf("failed to make request: %w", err)
+// checksumMetaKey is the user metadata entry holding the base64 SHA-256 checksum of an object written by S3Impl. It is
+// reserved, so writes that set it are rejected rather than having it overwritten.
+const checksumMetaKey = "checksum-sha256"
+
+func (s *S3Impl) readBlob(ctx context.Context, key, method, byteRange string, dst io.Writer) (size int64, etag string, meta map[string]string, err error) {
+	r, err := http.NewRequestWithContext(ctx, method, s.bucketUrl.ResolveReference(&url.URL{Path: key}).String(), nil)
+	if err != nil {
+		return size, etag, meta, fmt.Errorf("failed to build request: %w", err)
+	}
+	if byteRange != "" {
+		r.Header.Set("Range", byteRange)
+	} else if dst != nil {
+		r.Header.Set("x-amz-checksum-mode", "ENABLED")
+	}
+	if resp, err := s.client.Do(r); err != nil {
+		return size, etag, meta, fmt.Errorf("failed to make request: %w", err)
 	} else {
 		defer func() {
 			_ = resp.Body.Close()
 		}()
-		if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode != http.StatusOK && (byteRange == "" || resp.StatusCode != http.StatusPartialContent) {
 			if resp.StatusCode == http.StatusNotFound {
-				return size, meta, ErrObjectNotFound
-			}
-			bod, _ := io.ReadAll(resp.Body)
-			return size, meta, fmt.Errorf("failed to get objects due to status code: %s: %s", resp.Status, string(bod))
-		}
-		if dst != nil {
-			if r.Header.Get("Content-MD5") != "" {
-				dst = &hashWriter{H: md5.New(), W: dst}
-			}
-			if _, err := io.Copy(dst, resp.Body); err != nil {
-				return resp.ContentLength, meta, fmt.Errorf("failed to copy response body: %w", err)
-			}
-			if hA := r.Header.Get("Content-MD5"); hA != "" {
-				if hB := base64.StdEncoding.EncodeToString(dst.(*hashWriter).H.Sum(nil)); hA != hB {
-					return resp.ContentLength, meta, fmt.Errorf("integrity check failed: %s != %s", hA, hB)
-				}
+				return size, etag, meta, ErrObjectNotFound
+			} else if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+				return size, etag, meta, fmt.Errorf("%w: %s", ErrInvalidRange, byteRange)
 			}
+			return size, etag, meta, statusError("get objects", resp)
 		}
 		outMeta := make(map[string]string)
 		for k, v := range resp.Header {
@@ -226,21 +400,61 @@ func (s *S3Impl) readBlob(ctx context.Context, key, method string, dst io.Writer
 				outMeta[strings.TrimPrefix(k, "x-amz-meta-")] = v[0]
 			}
 		}
-		return resp.ContentLength, outMeta, nil
+		// prefer the checksum returned by providers that support flexible checksums over the copy in the metadata,
+		// composite checksums of multipart uploads can't be verified against the whole body
+		checksum := resp.Header.Get("x-amz-checksum-sha256")
+		if checksum == "" {
+			checksum = outMeta[checksumMetaKey]
+		}
+		delete(outMeta, checksumMetaKey)
+		if dst != nil {
+			verify := byteRange == "" && checksum != "" && !strings.Contains(checksum, "-")
+			if verify {
+				dst = &hashWriter{H: sha256.New(), W: dst}
+			}
+			if _, err := io.Copy(dst, resp.Body); err != nil {
+				return resp.ContentLength, etag, meta, fmt.Errorf("failed to copy response body: %w", err)
+			}
+			if verify {
+				if actual := base64.StdEncoding.EncodeToString(dst.(*hashWriter).H.Sum(nil)); actual != checksum {
+					return resp.ContentLength, etag, meta, fmt.Errorf("integrity check failed: %w: %s != %s", ErrChecksumMismatch, checksum, actual)
+				}
+			}
+		}
+		return resp.ContentLength, resp.Header.Get("ETag"), outMeta, nil
 	}
 }
 
 func (s *S3Impl) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
-	_, meta, err = s.readBlob(ctx, key, http.MethodGet, dst)
+	_, _, meta, err = s.readBlob(ctx, key, http.MethodGet, "", dst)
+	return meta, err
+}
+
+func (s *S3Impl) GetObjectETag(ctx context.Context, key string, dst io.Writer) (etag string, meta map[string]string, err error) {
+	_, etag, meta, err = s.readBlob(ctx, key, http.MethodGet, "", dst)
+	return etag, meta, err
+}
+
+func (s *S3Impl) GetObjectRange(ctx context.Context, key string, offset, length int64, dst io.Writer) (meta map[string]string, err error) {
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	_, _, meta, err = s.readBlob(ctx, key, http.MethodGet, byteRange, dst)
 	return meta, err
 }
 
 func (s *S3Impl) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
-	return s.readBlob(ctx, key, http.MethodHead, nil)
+	size, _, meta, err = s.readBlob(ctx, key, http.MethodHead, "", nil)
+	return size, meta, err
+}
+
+func (s *S3Impl) HeadObjectETag(ctx context.Context, key string) (size int64, etag string, meta map[string]string, err error) {
+	return s.readBlob(ctx, key, http.MethodHead, "", nil)
 }
 
 // listObjectsV2 performs https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html.
-func (s *S3Impl) listObjectsV2(ctx context.Context, prefix, delimiter, continuationToken string) (*ListBucketResult, error) {
+func (s *S3Impl) listObjectsV2(ctx context.Context, prefix, delimiter, startAfter, continuationToken string) (*ListBucketResult, error) {
 	q := make(url.Values)
 	q.Set("list-type", "2")
 	if prefix != "" {
@@ -249,6 +463,9 @@ func (s *S3Impl) listObjectsV2(ctx context.Context, prefix, delimiter, continuat
 	if delimiter != "" {
 		q.Set("delimiter", delimiter)
 	}
+	if startAfter != "" {
+		q.Set("start-after", startAfter)
+	}
 	if continuationToken != "" {
 		q.Set("continuation-token", continuationToken)
 	}
@@ -266,8 +483,7 @@ func (s *S3Impl) listObjectsV2(ctx context.Context, prefix, delimiter, continuat
 			_ = resp.Body.Close()
 		}()
 		if resp.StatusCode != http.StatusOK {
-			bod, _ := io.ReadAll(resp.Body)
-			return nil, fmt.Errorf("failed to list objects due to status code: %s: %s", resp.Status, string(bod))
+			return nil, statusError("list objects", resp)
 		}
 		var out ListBucketResult
 		if err := xml.NewDecoder(resp.Body).Decode(&out); err != nil {
@@ -277,17 +493,46 @@ func (s *S3Impl) listObjectsV2(ctx context.Context, prefix, delimiter, continuat
 	}
 }
 
+// statusError builds the error for an unexpected response status, wrapping ErrSlowDown when the provider asks us to
+// reduce the request rate.
+func statusError(action string, resp *http.Response) error {
+	bod, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("failed to %s due to status code: %s: %w: %s", action, resp.Status, ErrSlowDown, string(bod))
+	}
+	return fmt.Errorf("failed to %s due to status code: %s: %s", action, resp.Status, string(bod))
+}
+
 func expand[k any](in []k, n int) []k {
 	out := make([]k, len(in)+n)
 	copy(out, in)
 	return out[:len(in)]
 }
 
+// sleepContext waits for the given duration or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
 func (s *S3Impl) ListObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	return s.ListObjectsAfter(ctx, prefix, delimiter, "")
+}
+
+func (s *S3Impl) ListObjectsAfter(ctx context.Context, prefix, delimiter, startAfter string) (keys []string, sizes []int64, prefixes []string, err error) {
 	keys, sizes, prefixes = make([]string, 0), make([]int64, 0), make([]string, 0)
 	continuationToken := ""
 	for {
-		r, err := s.listObjectsV2(ctx, prefix, delimiter, continuationToken)
+		r, err := s.listObjectsV2(ctx, prefix, delimiter, startAfter, continuationToken)
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("failed to list objects: %w", err)
 		}
@@ -313,34 +558,57 @@ func (s *S3Impl) ListObjects(ctx context.Context, prefix string, delimiter strin
 }
 
 func (s *S3Impl) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
-	var checksum string
+	_, err = s.PutObjectIf(ctx, key, meta, body, PutCondition{})
+	return err
+}
+
+func (s *S3Impl) PutObjectIf(ctx context.Context, key string, meta map[string]string, body io.Reader, cond PutCondition) (etag string, err error) {
+	for k := range meta {
+		if strings.EqualFold(k, checksumMetaKey) {
+			return "", fmt.Errorf("object meta '%s' is reserved", k)
+		}
+	}
+	var checksum, checksumSha256 string
 	if raw, err := io.ReadAll(body); err != nil {
-		return fmt.Errorf("failed to read buffered body: %w", err)
+		return "", fmt.Errorf("failed to read buffered body: %w", err)
 	} else {
 		h := md5.New()
 		_, _ = h.Write(raw)
 		checksum = base64.StdEncoding.EncodeToString(h.Sum(nil))
+		sum := sha256.Sum256(raw)
+		checksumSha256 = base64.StdEncoding.EncodeToString(sum[:])
 		body = bytes.NewReader(raw)
 	}
 	if r, err := http.NewRequestWithContext(ctx, http.MethodPut, s.bucketUrl.ResolveReference(&url.URL{Path: key}).String(), body); err != nil {
-		return fmt.Errorf("failed to build request: %w", err)
+		return "", fmt.Errorf("failed to build request: %w", err)
 	} else {
 		r.Header.Set("Content-MD5", checksum)
+		r.Header.Set("x-amz-checksum-sha256", checksumSha256)
 		for s2, s3 := range meta {
 			r.Header.Set("x-amz-meta-"+s2, s3)
 		}
+		// stored as metadata too for providers that ignore flexible checksums
+		r.Header.Set("x-amz-meta-"+checksumMetaKey, checksumSha256)
+		if cond.IfNoneMatch {
+			r.Header.Set("If-None-Match", "*")
+		}
+		if cond.IfMatch != "" {
+			r.Header.Set("If-Match", cond.IfMatch)
+		}
 		if resp, err := s.client.Do(r); err != nil {
-			return fmt.Errorf("failed to make request: %w", err)
+			return "", fmt.Errorf("failed to make request: %w", err)
 		} else {
 			defer func() {
 				_ = resp.Body.Close()
 			}()
-			if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
-				raw, _ := io.ReadAll(resp.Body)
-				return fmt.Errorf("failed to make put request due to status code: %s: %s", resp.Status, string(raw))
+			// 409 is returned when a conflicting conditional write is in progress
+			if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict {
+				return "", fmt.Errorf("%w: %s", ErrPreconditionFailed, statusError("make put request", resp))
+			} else if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+				return "", statusError("make put request", resp)
 			}
+			return resp.Header.Get("ETag"), nil
 		}
-		return nil
 	}
 }
 
@@ -356,8 +624,7 @@ func (s *S3Impl) DeleteObject(ctx context.Context, key string) error {
 		// delete object has various interpretations depending on the storage provider. GCS doesn't support bulk delete and returns
 		// a 404 for objects that are not found which is wrong but we should handle it here.
 		if (resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices) && resp.StatusCode != http.StatusNotFound {
-			bod, _ := io.ReadAll(resp.Body)
-			return fmt.Errorf("failed to make delete request due to status code: %s: %s", resp.Status, string(bod))
+			return statusError("make delete request", resp)
 		}
 		return nil
 	}
@@ -380,53 +647,7 @@ type ListBucketObject struct {
 }
 
 var _ S3 = (*S3Impl)(nil)
-
-type ClientEncryptedS3 struct {
-	S3
-	BlockCipher cipher.Block
-}
-
-func (s *ClientEncryptedS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
-	buff := new(bytes.Buffer)
-	if meta, err = s.S3.GetObject(ctx, key, buff); err != nil {
-		return nil, err
-	} else if metaCipherMode := meta["cipher-mode"]; metaCipherMode != "GCM" {
-		return nil, fmt.Errorf("object meta cipher-mode '%s' != GCM", metaCipherMode)
-	} else if gcm, err := cipher.NewGCM(s.BlockCipher); err != nil {
-		return nil, fmt.Errorf("failed to initialise gcm cipher: %w", err)
-	} else if buff.Len() < gcm.NonceSize() {
-		return nil, fmt.Errorf("data size is too small to read gcm nonce")
-	} else {
-		n := make([]byte, gcm.NonceSize())
-		_, _ = buff.Read(n)
-		b := buff.Bytes()
-		if bo, err := gcm.Open(b[:0], n, b, nil); err != nil {
-			return nil, fmt.Errorf("failed to decrypt: %w", err)
-		} else if _, err = dst.Write(bo); err != nil {
-			return nil, fmt.Errorf("failed to write: %w", err)
-		}
-		return meta, nil
-	}
-}
-
-func (s *ClientEncryptedS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
-	if gcm, err := cipher.NewGCM(s.BlockCipher); err != nil {
-		return fmt.Errorf("failed to initialise gcm cipher: %w", err)
-	} else if n, err := io.ReadAll(body); err != nil {
-		return fmt.Errorf("failed to buffer data: %w", err)
-	} else {
-		meta = maps.Clone(meta)
-		if meta == nil {
-			meta = make(map[string]string)
-		}
-		meta["cipher-mode"] = "GCM"
-		nonce := make([]byte, gcm.NonceSize())
-		if _, err := rand.Read(nonce); err != nil {
-			return fmt.Errorf("failed to generate nonce: %w", err)
-		}
-		return s.S3.PutObject(ctx, key, meta, io.MultiReader(
-			bytes.NewReader(nonce),
-			bytes.NewReader(gcm.Seal(n[:0], nonce, n, nil)),
-		))
-	}
-}
+var _ RangeGetter = (*S3Impl)(nil)
+var _ ETagGetter = (*S3Impl)(nil)
+var _ StartAfterLister = (*S3Impl)(nil)
+var _ ConditionalPutter = (*S3Impl)(nil)
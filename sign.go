@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -53,7 +54,11 @@ func uriEncode(in string, out io.Writer) {
 func buildCanonicalRequest(r *http.Request, t time.Time) (string, error) {
 	r.Header.Set("x-amz-date", t.UTC().Format("20060102T150405Z"))
 	r.Header.Set("Host", r.Host)
-	contentSha256 := r.Header.Get("x-amz-checksum-sha256")
+	var contentSha256 string
+	// the checksum header is base64 encoded while the content hash must be hex encoded
+	if raw, err := base64.StdEncoding.DecodeString(r.Header.Get("x-amz-checksum-sha256")); err == nil && len(raw) == sha256.Size {
+		contentSha256 = hex.EncodeToString(raw)
+	}
 	if contentSha256 == "" {
 		h := sha256.New()
 		if r.Body != nil {
@@ -192,3 +192,13 @@ func TestBuildCanonicalRequest_eg_get_list_objects(t *testing.T) {
 			"Signature=34b48302e7b5fa45bde8084f4b7868a86f0a534bc59db6670ed5711ef69dc6f7",
 	)
 }
+
+func TestBuildCanonicalRequest_checksum_header(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPut, "https://examplebucket.s3.amazonaws.com/a", strings.NewReader("Welcome to Amazon S3."))
+	AssertEqual(t, err, nil)
+	// base64 of the sha256 of the body
+	r.Header.Set("x-amz-checksum-sha256", "RM591nyVng01JP+sF3Hfu6h9K2tLTpnkIDSouAP4sHI=")
+	_, err = buildCanonicalRequest(r, time.Now())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, r.Header.Get("x-amz-content-sha256"), "44ce7dd67c959e0d3524ffac1771dfbba87d2b6b4b4e99e42034a8b803f8b072")
+}
@@ -0,0 +1,159 @@
+package automerge_s3_sync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The segmented format splits the plaintext into fixed size segments which are sealed independently so that objects
+// can be encrypted and decrypted as a stream and decrypted partially for ranged reads. The ciphertext consists of a
+// random nonce prefix followed by each sealed segment. The nonce of each segment is the prefix, the big-endian segment
+// index and a flag byte that is 1 only for the final segment, so segments can't be reordered, dropped or truncated
+// without failing authentication. Every object has at least one (possibly empty) segment.
+
+// streamPrefixSize leaves room for a 4 byte segment index and the final segment flag in the nonce.
+func streamPrefixSize(aead cipher.AEAD) int {
+	return aead.NonceSize() - 5
+}
+
+func segmentNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, len(prefix)+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[len(prefix):], index)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// segmentCount returns the number of segments and the plaintext size of a segmented ciphertext of the given size. The
+// nonceSize and overhead are those of the AEAD.
+func segmentCount(nonceSize, overhead, segmentSize int, ciphertextSize int64) (segments int64, plaintextSize int64, err error) {
+	sealedSegmentSize := int64(segmentSize + overhead)
+	body := ciphertextSize - int64(nonceSize-5)
+	if body < int64(overhead) {
+		return 0, 0, fmt.Errorf("ciphertext size %d is too small for the segmented format", ciphertextSize)
+	}
+	segments = (body + sealedSegmentSize - 1) / sealedSegmentSize
+	return segments, body - segments*int64(overhead), nil
+}
+
+// sealSegments reads the plaintext from src and writes the segmented ciphertext to dst.
+func sealSegments(aead cipher.AEAD, segmentSize int, additionalData []byte, src io.Reader, dst io.Writer) error {
+	prefix := make([]byte, streamPrefixSize(aead))
+	if _, err := rand.Read(prefix); err != nil {
+		return fmt.Errorf("failed to generate nonce prefix: %w", err)
+	} else if _, err := dst.Write(prefix); err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(src, segmentSize)
+	segment := make([]byte, segmentSize, segmentSize+aead.Overhead())
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(br, segment)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read plaintext: %w", err)
+		}
+		final := err != nil
+		if !final {
+			if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+				final = true
+			} else if err != nil {
+				return fmt.Errorf("failed to read plaintext: %w", err)
+			}
+		}
+		if _, err := dst.Write(aead.Seal(segment[:0], segmentNonce(prefix, index, final), segment[:n], additionalData)); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		} else if index == ^uint32(0) {
+			return errors.New("too many segments")
+		}
+	}
+}
+
+// segmentOpener is a writer that accepts segmented ciphertext and writes the authenticated plaintext to the
+// destination as each segment completes. Close must be called once all the ciphertext has been written to
+// authenticate the final segment.
+type segmentOpener struct {
+	aead           cipher.AEAD
+	segmentSize    int
+	additionalData []byte
+	dst            io.Writer
+
+	prefix []byte
+	index  uint32
+	final  bool
+	buff   []byte
+}
+
+func newSegmentOpener(aead cipher.AEAD, segmentSize int, additionalData []byte, dst io.Writer) *segmentOpener {
+	return &segmentOpener{aead: aead, segmentSize: segmentSize, additionalData: additionalData, dst: dst}
+}
+
+func (o *segmentOpener) Write(p []byte) (n int, err error) {
+	o.buff = append(o.buff, p...)
+	if o.prefix == nil {
+		if len(o.buff) < streamPrefixSize(o.aead) {
+			return len(p), nil
+		}
+		o.prefix = bytes.Clone(o.buff[:streamPrefixSize(o.aead)])
+		o.buff = o.buff[len(o.prefix):]
+	}
+	sealedSegmentSize := o.segmentSize + o.aead.Overhead()
+	// the last complete segment is held back until we know whether it is the final one
+	var consumed int
+	for len(o.buff)-consumed > sealedSegmentSize {
+		if err := o.open(o.buff[consumed:consumed+sealedSegmentSize], false); err != nil {
+			return 0, err
+		}
+		consumed += sealedSegmentSize
+	}
+	o.buff = append(o.buff[:0], o.buff[consumed:]...)
+	return len(p), nil
+}
+
+func (o *segmentOpener) open(sealed []byte, final bool) error {
+	if o.final {
+		return errors.New("data found after final segment")
+	} else if plain, err := o.aead.Open(nil, segmentNonce(o.prefix, o.index, final), sealed, o.additionalData); err != nil {
+		return fmt.Errorf("failed to decrypt segment %d: %w", o.index, err)
+	} else if _, err := o.dst.Write(plain); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	o.index++
+	o.final = final
+	return nil
+}
+
+func (o *segmentOpener) Close() error {
+	if o.final {
+		return nil
+	} else if o.prefix == nil || len(o.buff) < o.aead.Overhead() {
+		return errors.New("segmented ciphertext is truncated")
+	}
+	return o.open(o.buff, true)
+}
+
+var _ io.WriteCloser = (*segmentOpener)(nil)
+
+// openSegmentRange decrypts consecutive sealed segments starting at firstIndex of an object with totalSegments segments.
+func openSegmentRange(aead cipher.AEAD, segmentSize int, additionalData, prefix []byte, firstIndex, totalSegments int64, sealed []byte) ([]byte, error) {
+	sealedSegmentSize := segmentSize + aead.Overhead()
+	out := make([]byte, 0, len(sealed))
+	for index := firstIndex; len(sealed) > 0; index++ {
+		segment := sealed[:min(sealedSegmentSize, len(sealed))]
+		sealed = sealed[len(segment):]
+		var err error
+		if out, err = aead.Open(out, segmentNonce(prefix, uint32(index), index == totalSegments-1), segment, additionalData); err != nil {
+			return nil, fmt.Errorf("failed to decrypt segment %d: %w", index, err)
+		}
+	}
+	return out, nil
+}
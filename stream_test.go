@@ -0,0 +1,132 @@
+package automerge_s3_sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestClientEncryptedS3_segmented(t *testing.T) {
+	testS3Interface(t, &ClientEncryptedS3{S3: &InMemoryS3{}, BlockCipher: newTestBlockCipher(t), SegmentSize: 1024})
+}
+
+func TestClientEncryptedS3_segmented_round_trip(t *testing.T) {
+	bc := newTestBlockCipher(t)
+	for _, size := range []int{0, 1, 15, 16, 17, 48, 100} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			inner := &InMemoryS3{}
+			plain := make([]byte, size)
+			_, _ = rand.Read(plain)
+			s := &ClientEncryptedS3{S3: inner, BlockCipher: bc, SegmentSize: 16}
+			AssertEqual(t, s.PutObject(context.Background(), "a", nil, bytes.NewReader(plain)), nil)
+
+			n, m, err := inner.HeadObject(context.Background(), "a")
+			AssertEqual(t, err, nil)
+			AssertEqual(t, m["cipher-mode"], "GCM-STREAM")
+			AssertEqual(t, m["cipher-segment-size"], "16")
+			segments := max(1, (size+15)/16)
+			AssertEqual(t, n, int64(7+size+16*segments))
+
+			// streamed
+			buff := new(bytes.Buffer)
+			_, err = s.GetObject(context.Background(), "a", buff)
+			AssertEqual(t, err, nil)
+			AssertEqual(t, bytes.Equal(buff.Bytes(), plain), true)
+
+			// buffered
+			buff.Reset()
+			_, err = (&ClientEncryptedS3{S3: inner, BlockCipher: bc}).GetObject(context.Background(), "a", buff)
+			AssertEqual(t, err, nil)
+			AssertEqual(t, bytes.Equal(buff.Bytes(), plain), true)
+		})
+	}
+}
+
+func TestClientEncryptedS3_segmented_tampering(t *testing.T) {
+	inner := &InMemoryS3{}
+	s := &ClientEncryptedS3{S3: inner, BlockCipher: newTestBlockCipher(t), SegmentSize: 4}
+	tamper := func(t *testing.T, f func(sealed []byte) []byte) error {
+		AssertEqual(t, s.PutObject(context.Background(), "a", nil, bytes.NewReader([]byte("0123456789"))), nil)
+		raw := new(bytes.Buffer)
+		m, err := inner.GetObject(context.Background(), "a", raw)
+		AssertEqual(t, err, nil)
+		AssertEqual(t, inner.PutObject(context.Background(), "a", m, bytes.NewReader(f(raw.Bytes()))), nil)
+		_, err = s.GetObject(context.Background(), "a", new(bytes.Buffer))
+		return err
+	}
+
+	t.Run("untouched", func(t *testing.T) {
+		AssertEqual(t, tamper(t, func(sealed []byte) []byte {
+			return sealed
+		}), nil)
+	})
+
+	t.Run("truncated to segment boundary", func(t *testing.T) {
+		AssertErrorEqual(t, tamper(t, func(sealed []byte) []byte {
+			return sealed[:7+20*2]
+		}), "failed to decrypt segment 1: cipher: message authentication failed")
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		AssertErrorEqual(t, tamper(t, func(sealed []byte) []byte {
+			return sealed[:10]
+		}), "segmented ciphertext is truncated")
+	})
+
+	t.Run("reordered", func(t *testing.T) {
+		AssertErrorEqual(t, tamper(t, func(sealed []byte) []byte {
+			return slices.Concat(sealed[:7], sealed[27:47], sealed[7:27], sealed[47:])
+		}), "failed to decrypt segment 0: cipher: message authentication failed")
+	})
+
+	t.Run("extended", func(t *testing.T) {
+		AssertErrorEqual(t, tamper(t, func(sealed []byte) []byte {
+			return slices.Concat(sealed, sealed[7:27])
+		}), "failed to decrypt segment 2: cipher: message authentication failed")
+	})
+}
+
+func TestClientEncryptedS3_range(t *testing.T) {
+	plain := []byte("abcdefghijklmnopqrstuvwxyz")
+	for _, segmentSize := range []int{0, 4} {
+		t.Run(fmt.Sprint(segmentSize), func(t *testing.T) {
+			s := &ClientEncryptedS3{S3: &InMemoryS3{}, BlockCipher: newTestBlockCipher(t), SegmentSize: segmentSize}
+			AssertEqual(t, s.PutObject(context.Background(), "a", map[string]string{"x": "y"}, bytes.NewReader(plain)), nil)
+			for _, tc := range []struct {
+				offset, length int64
+				expected       string
+			}{
+				{0, 1, "a"},
+				{0, 4, "abcd"},
+				{3, 2, "de"},
+				{3, 10, "defghijklm"},
+				{22, 0, "wxyz"},
+				{25, 100, "z"},
+			} {
+				buff := new(bytes.Buffer)
+				m, err := s.GetObjectRange(context.Background(), "a", tc.offset, tc.length, buff)
+				AssertEqual(t, err, nil)
+				AssertEqual(t, m["x"], "y")
+				AssertEqual(t, buff.String(), tc.expected)
+			}
+			_, err := s.GetObjectRange(context.Background(), "a", 26, 1, new(bytes.Buffer))
+			AssertErrorIs(t, err, ErrInvalidRange)
+		})
+	}
+}
+
+func TestClientEncryptedS3_segmented_sizes(t *testing.T) {
+	s := &ClientEncryptedS3{S3: &InMemoryS3{}, BlockCipher: newTestBlockCipher(t), SegmentSize: 16}
+	for _, size := range []int{0, 16, 17, 100} {
+		AssertEqual(t, s.PutObject(context.Background(), fmt.Sprintf("%03d", size), nil, bytes.NewReader(make([]byte, size))), nil)
+		n, _, err := s.HeadObject(context.Background(), fmt.Sprintf("%03d", size))
+		AssertEqual(t, err, nil)
+		AssertEqual(t, n, int64(size))
+	}
+	_, sizes, _, err := s.ListObjects(context.Background(), "", "")
+	AssertEqual(t, err, nil)
+	AssertEqual(t, sizes, []int64{0, 16, 17, 100})
+}
@@ -0,0 +1,275 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket limit of Rate operations per second with bursts of up to Burst operations. A zero Rate
+// is unlimited.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token at the given rate and returns how long to wait before it may be used. Tokens can go
+// negative so that waiters are served in order.
+func (b *tokenBucket) reserve(now time.Time, rate float64, burst int) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	capacity := float64(max(1, burst))
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// refund gives back a token that was reserved at the given rate but not used.
+func (b *tokenBucket) refund(rate float64, burst int) {
+	if rate > 0 {
+		b.tokens = min(float64(max(1, burst)), b.tokens+1)
+	}
+}
+
+type operationClass int
+
+const (
+	classRead operationClass = iota
+	classWrite
+	classList
+)
+
+const (
+	// slowDownDecrease is the factor the rates are multiplied by when the provider asks us to slow down.
+	slowDownDecrease = 0.5
+	// recoveryIncrease is added to the rate factor after every successful operation.
+	recoveryIncrease = 0.02
+	// minRateFactor bounds how far the rates can be reduced.
+	minRateFactor = 1.0 / 64
+)
+
+// ThrottledS3 limits the rate of operations on the underlying S3 with a token bucket per class of operation (reads
+// are GetObject and HeadObject, writes are PutObject and DeleteObject) and caps the number of operations in flight at
+// MaxInFlight if it's positive. When an operation fails with ErrSlowDown the rates and the in-flight cap are halved,
+// and they recover additively as operations succeed again. Waiting is abandoned when the context is done.
+type ThrottledS3 struct {
+	S3
+	Reads       RateLimit
+	Writes      RateLimit
+	Lists       RateLimit
+	MaxInFlight int
+
+	mux      sync.Mutex
+	buckets  [3]tokenBucket
+	inFlight int
+	released chan struct{}
+	// slowDown is how far the limits have been reduced, the rate factor is 1-slowDown.
+	slowDown float64
+}
+
+func (s *ThrottledS3) factor() float64 {
+	return 1 - s.slowDown
+}
+
+func (s *ThrottledS3) limit(class operationClass) RateLimit {
+	switch class {
+	case classWrite:
+		return s.Writes
+	case classList:
+		return s.Lists
+	default:
+		return s.Reads
+	}
+}
+
+// acquire waits for a token of the class and then for an in-flight slot. The token is given back if the context is
+// done before the operation can start.
+func (s *ThrottledS3) acquire(ctx context.Context, class operationClass) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mux.Lock()
+	l := s.limit(class)
+	delay := s.buckets[class].reserve(time.Now(), l.Rate*s.factor(), l.Burst)
+	s.mux.Unlock()
+	if err := sleepContext(ctx, delay); err != nil {
+		s.refund(class)
+		return err
+	}
+
+	for {
+		s.mux.Lock()
+		if s.MaxInFlight <= 0 || s.inFlight < max(1, int(math.Floor(float64(s.MaxInFlight)*s.factor()))) {
+			s.inFlight++
+			s.mux.Unlock()
+			return nil
+		}
+		if s.released == nil {
+			s.released = make(chan struct{})
+		}
+		released := s.released
+		s.mux.Unlock()
+		select {
+		case <-ctx.Done():
+			s.refund(class)
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// refund gives back the token of the class taken by an operation that didn't start.
+func (s *ThrottledS3) refund(class operationClass) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	l := s.limit(class)
+	s.buckets[class].refund(l.Rate, l.Burst)
+}
+
+// release frees the in-flight slot and adapts the limits to the outcome of the operation.
+func (s *ThrottledS3) release(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.inFlight--
+	if errors.Is(err, ErrSlowDown) {
+		s.slowDown = 1 - max(minRateFactor, s.factor()*slowDownDecrease)
+	} else if err == nil {
+		s.slowDown = max(0, s.slowDown-recoveryIncrease)
+	}
+	if s.released != nil {
+		close(s.released)
+		s.released = nil
+	}
+}
+
+func (s *ThrottledS3) GetObject(ctx context.Context, key string, dst io.Writer) (meta map[string]string, err error) {
+	if err := s.acquire(ctx, classRead); err != nil {
+		return nil, err
+	}
+	defer func() {
+		s.release(err)
+	}()
+	return s.S3.GetObject(ctx, key, dst)
+}
+
+func (s *ThrottledS3) HeadObject(ctx context.Context, key string) (size int64, meta map[string]string, err error) {
+	if err := s.acquire(ctx, classRead); err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		s.release(err)
+	}()
+	return s.S3.HeadObject(ctx, key)
+}
+
+func (s *ThrottledS3) ListObjects(ctx context.Context, prefix string, delimiter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	if err := s.acquire(ctx, classList); err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() {
+		s.release(err)
+	}()
+	return s.S3.ListObjects(ctx, prefix, delimiter)
+}
+
+// ListObjectsAfter uses the start-after support of the underlying S3 if it has any.
+func (s *ThrottledS3) ListObjectsAfter(ctx context.Context, prefix, delimiter, startAfter string) (keys []string, sizes []int64, prefixes []string, err error) {
+	if err := s.acquire(ctx, classList); err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() {
+		s.release(err)
+	}()
+	return listObjectsAfter(ctx, s.S3, prefix, delimiter, startAfter)
+}
+
+func (s *ThrottledS3) PutObject(ctx context.Context, key string, meta map[string]string, body io.Reader) (err error) {
+	if err := s.acquire(ctx, classWrite); err != nil {
+		return err
+	}
+	defer func() {
+		s.release(err)
+	}()
+	return s.S3.PutObject(ctx, key, meta, body)
+}
+
+func (s *ThrottledS3) DeleteObject(ctx context.Context, key string) (err error) {
+	if err := s.acquire(ctx, classWrite); err != nil {
+		return err
+	}
+	defer func() {
+		s.release(err)
+	}()
+	return s.S3.DeleteObject(ctx, key)
+}
+
+var _ S3 = (*ThrottledS3)(nil)
+var _ StartAfterLister = (*ThrottledS3)(nil)
+
+// conditionalThrottledS3 is a ThrottledS3 over a store that implements ETagGetter and ConditionalPutter, which
+// throttles those operations too instead of hiding them.
+type conditionalThrottledS3 struct {
+	*ThrottledS3
+	getter ETagGetter
+	putter ConditionalPutter
+}
+
+// withConditionalWrites returns s with the ETag and conditional write support of the underlying S3, if it has both.
+func withConditionalWrites(s *ThrottledS3) S3 {
+	getter, canGet := s.S3.(ETagGetter)
+	putter, canPut := s.S3.(ConditionalPutter)
+	if !canGet || !canPut {
+		return s
+	}
+	return &conditionalThrottledS3{ThrottledS3: s, getter: getter, putter: putter}
+}
+
+func (s *conditionalThrottledS3) GetObjectETag(ctx context.Context, key string, dst io.Writer) (etag string, meta map[string]string, err error) {
+	if err := s.acquire(ctx, classRead); err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		s.release(err)
+	}()
+	return s.getter.GetObjectETag(ctx, key, dst)
+}
+
+func (s *conditionalThrottledS3) HeadObjectETag(ctx context.Context, key string) (size int64, etag string, meta map[string]string, err error) {
+	if err := s.acquire(ctx, classRead); err != nil {
+		return 0, "", nil, err
+	}
+	defer func() {
+		s.release(err)
+	}()
+	return s.getter.HeadObjectETag(ctx, key)
+}
+
+func (s *conditionalThrottledS3) PutObjectIf(ctx context.Context, key string, meta map[string]string, body io.Reader, cond PutCondition) (etag string, err error) {
+	if err := s.acquire(ctx, classWrite); err != nil {
+		return "", err
+	}
+	defer func() {
+		s.release(err)
+	}()
+	return s.putter.PutObjectIf(ctx, key, meta, body, cond)
+}
+
+var _ ETagGetter = (*conditionalThrottledS3)(nil)
+var _ ConditionalPutter = (*conditionalThrottledS3)(nil)
@@ -0,0 +1,118 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThrottledS3(t *testing.T) {
+	testS3Interface(t, &ThrottledS3{S3: &InMemoryS3{}, Reads: RateLimit{Rate: 1000, Burst: 10}, MaxInFlight: 2})
+}
+
+func TestThrottledS3_rate(t *testing.T) {
+	s := &ThrottledS3{S3: &InMemoryS3{}, Reads: RateLimit{Rate: 100, Burst: 2}}
+	start := time.Now()
+	for range 6 {
+		_, _, err := s.HeadObject(context.Background(), "a")
+		AssertErrorIs(t, err, ErrObjectNotFound)
+	}
+	AssertEqual(t, time.Since(start) >= 35*time.Millisecond, true)
+
+	// writes are not limited by the read rate
+	start = time.Now()
+	for range 6 {
+		AssertEqual(t, s.DeleteObject(context.Background(), "a"), nil)
+	}
+	AssertEqual(t, time.Since(start) < 35*time.Millisecond, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	s.Reads.Rate = 0.1
+	_, _, err := s.HeadObject(ctx, "a")
+	AssertErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestThrottledS3_cancelled_refund(t *testing.T) {
+	s := &ThrottledS3{S3: &InMemoryS3{}, Reads: RateLimit{Rate: 10, Burst: 1}}
+	_, _, err := s.HeadObject(context.Background(), "a")
+	AssertErrorIs(t, err, ErrObjectNotFound)
+	for range 5 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		_, _, err := s.HeadObject(ctx, "a")
+		cancel()
+		AssertErrorIs(t, err, context.DeadlineExceeded)
+	}
+	// the cancelled reads gave their tokens back, so this one only waits for the next token
+	start := time.Now()
+	_, _, err = s.HeadObject(context.Background(), "a")
+	AssertErrorIs(t, err, ErrObjectNotFound)
+	AssertEqual(t, time.Since(start) < 300*time.Millisecond, true)
+}
+
+// concurrencyS3 records the highest number of concurrent GetObject and ListObjects calls.
+type concurrencyS3 struct {
+	S3
+	current, highest atomic.Int64
+}
+
+func (c *concurrencyS3) track() func() {
+	n := c.current.Add(1)
+	for h := c.highest.Load(); n > h && !c.highest.CompareAndSwap(h, n); h = c.highest.Load() {
+	}
+	time.Sleep(5 * time.Millisecond)
+	return func() {
+		c.current.Add(-1)
+	}
+}
+
+func (c *concurrencyS3) GetObject(ctx context.Context, key string, dst io.Writer) (map[string]string, error) {
+	defer c.track()()
+	return c.S3.GetObject(ctx, key, dst)
+}
+
+func (c *concurrencyS3) ListObjects(ctx context.Context, prefix string, delimiter string) ([]string, []int64, []string, error) {
+	defer c.track()()
+	return c.S3.ListObjects(ctx, prefix, delimiter)
+}
+
+func TestThrottledS3_in_flight(t *testing.T) {
+	inner := &concurrencyS3{S3: &InMemoryS3{}}
+	s := &ThrottledS3{S3: inner, MaxInFlight: 3}
+	AssertEqual(t, s.PutObject(context.Background(), "a", nil, strings.NewReader("x")), nil)
+	var wg sync.WaitGroup
+	for range 12 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.GetObject(context.Background(), "a", io.Discard)
+			AssertEqual(t, err, nil)
+		}()
+	}
+	wg.Wait()
+	AssertEqual(t, inner.highest.Load(), int64(3))
+}
+
+func TestThrottledS3_slow_down(t *testing.T) {
+	inner := &FaultyS3{S3: &InMemoryS3{}, Rules: []*FaultRule{{Kind: FaultSlowDown, Times: 2}}}
+	s := &ThrottledS3{S3: inner, MaxInFlight: 8}
+	for range 2 {
+		_, _, _, err := s.ListObjects(context.Background(), "", "")
+		AssertErrorIs(t, err, ErrSlowDown)
+	}
+	AssertEqual(t, s.factor(), 0.25)
+
+	for range 5 {
+		_, _, _, err := s.ListObjects(context.Background(), "", "")
+		AssertEqual(t, err, nil)
+	}
+	AssertEqual(t, s.factor() > 0.34 && s.factor() < 0.36, true)
+	for range 100 {
+		_, _, _, _ = s.ListObjects(context.Background(), "", "")
+	}
+	AssertEqual(t, s.factor(), 1.0)
+}
@@ -0,0 +1,136 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWatchMinInterval = time.Second
+	DefaultWatchMaxInterval = 30 * time.Second
+)
+
+// Watcher polls the change log of a document and delivers the changes it hasn't seen before, in sequence order per
+// peer. The poll interval starts at MinInterval and doubles up to MaxInterval while there are no new changes, and
+// Nudge triggers an immediate poll, for example after a local write.
+//
+// New changes are passed to OnChanges if it is set, otherwise they are sent on C, and one of them is required. Errors
+// are passed to OnError if it is set and the watcher keeps polling with backoff. Changes before a gap in a peer's
+// sequence are delivered and the rest are picked up by a later poll once they become visible.
+type Watcher struct {
+	ChangeLog *ChangeLog
+	// Since is the last sequence number already seen from each peer when the watcher starts.
+	Since       map[string]uint64
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	OnChanges   func(refs []ChangeRef)
+	C           chan []ChangeRef
+	OnError     func(err error)
+
+	initOnce sync.Once
+	// pollMux serialises polls so that concurrent ones can't deliver the same changes twice.
+	pollMux sync.Mutex
+	mux     sync.Mutex
+	seen    map[string]uint64
+	nudge   chan struct{}
+}
+
+func (w *Watcher) init() {
+	w.initOnce.Do(func() {
+		w.seen = maps.Clone(w.Since)
+		if w.seen == nil {
+			w.seen = make(map[string]uint64)
+		}
+		w.nudge = make(chan struct{}, 1)
+	})
+}
+
+// HighWaterMarks returns the last sequence number delivered from each peer.
+func (w *Watcher) HighWaterMarks() map[string]uint64 {
+	w.init()
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return maps.Clone(w.seen)
+}
+
+// Nudge makes a running watcher poll immediately.
+func (w *Watcher) Nudge() {
+	w.init()
+	select {
+	case w.nudge <- struct{}{}:
+	default:
+	}
+}
+
+// errNoWatchSink is returned by a Watcher that has nowhere to deliver changes.
+var errNoWatchSink = errors.New("watcher requires OnChanges or C")
+
+// Poll lists the change log once and delivers any new changes. It returns the delivered changes.
+func (w *Watcher) Poll(ctx context.Context) ([]ChangeRef, error) {
+	w.init()
+	if w.OnChanges == nil && w.C == nil {
+		return nil, errNoWatchSink
+	}
+	w.pollMux.Lock()
+	defer w.pollMux.Unlock()
+	refs, err := w.ChangeLog.Changes(ctx, w.HighWaterMarks())
+	if err != nil && !errors.Is(err, ErrChangeGap) && !errors.Is(err, ErrDuplicateChange) {
+		return nil, err
+	}
+	if len(refs) > 0 {
+		if w.OnChanges != nil {
+			w.OnChanges(refs)
+		} else {
+			select {
+			case w.C <- refs:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		w.mux.Lock()
+		w.seen = HighWaterMarks(w.seen, refs)
+		w.mux.Unlock()
+	}
+	return refs, err
+}
+
+// Run polls until the context is done and returns its error.
+func (w *Watcher) Run(ctx context.Context) error {
+	w.init()
+	if w.OnChanges == nil && w.C == nil {
+		return errNoWatchSink
+	}
+	minInterval, maxInterval := w.MinInterval, w.MaxInterval
+	if minInterval <= 0 {
+		minInterval = DefaultWatchMinInterval
+	}
+	if maxInterval <= 0 {
+		maxInterval = DefaultWatchMaxInterval
+	}
+	maxInterval = max(minInterval, maxInterval)
+	interval := minInterval
+	for {
+		refs, err := w.Poll(ctx)
+		if err != nil && ctx.Err() == nil && w.OnError != nil {
+			w.OnError(err)
+		}
+		if len(refs) > 0 {
+			interval = minInterval
+		}
+
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-w.nudge:
+			t.Stop()
+			interval = minInterval
+		case <-t.C:
+			interval = min(interval*2, maxInterval)
+		}
+	}
+}
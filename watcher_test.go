@@ -0,0 +1,112 @@
+package automerge_s3_sync
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatcher_poll(t *testing.T) {
+	c := &ChangeLog{S3: &InMemoryS3{}, DocumentId: "doc-1"}
+	var delivered [][]ChangeRef
+	w := &Watcher{ChangeLog: c, Since: map[string]uint64{"peer-a": 1}, OnChanges: func(refs []ChangeRef) {
+		delivered = append(delivered, refs)
+	}}
+	for _, seq := range []uint64{1, 2, 3} {
+		AssertEqual(t, c.Append(context.Background(), "peer-a", seq, nil, strings.NewReader("x")), nil)
+	}
+	refs, err := w.Poll(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(refs), 2)
+	refs, err = w.Poll(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(refs), 0)
+	AssertEqual(t, len(delivered), 1)
+	AssertEqual(t, w.HighWaterMarks(), map[string]uint64{"peer-a": 3})
+
+	// changes after a gap are delivered once it is filled
+	AssertEqual(t, c.Append(context.Background(), "peer-a", 5, nil, strings.NewReader("x")), nil)
+	refs, err = w.Poll(context.Background())
+	AssertErrorIs(t, err, ErrChangeGap)
+	AssertEqual(t, len(refs), 0)
+	AssertEqual(t, c.Append(context.Background(), "peer-a", 4, nil, strings.NewReader("x")), nil)
+	refs, err = w.Poll(context.Background())
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(refs), 2)
+	AssertEqual(t, w.HighWaterMarks(), map[string]uint64{"peer-a": 5})
+}
+
+func TestWatcher_concurrent_poll(t *testing.T) {
+	c := &ChangeLog{S3: &InMemoryS3{}, DocumentId: "doc-1"}
+	AssertEqual(t, c.Append(context.Background(), "peer-a", 1, nil, strings.NewReader("x")), nil)
+	var mux sync.Mutex
+	var delivered int
+	w := &Watcher{ChangeLog: c, OnChanges: func(refs []ChangeRef) {
+		mux.Lock()
+		delivered += len(refs)
+		mux.Unlock()
+	}}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := w.Poll(context.Background())
+			AssertEqual(t, err, nil)
+		}()
+	}
+	wg.Wait()
+	AssertEqual(t, delivered, 1)
+}
+
+func TestWatcher_no_sink(t *testing.T) {
+	w := &Watcher{ChangeLog: &ChangeLog{S3: &InMemoryS3{}, DocumentId: "doc-1"}}
+	_, err := w.Poll(context.Background())
+	AssertErrorEqual(t, err, "watcher requires OnChanges or C")
+	AssertErrorEqual(t, w.Run(context.Background()), "watcher requires OnChanges or C")
+	AssertEqual(t, w.HighWaterMarks(), map[string]uint64{})
+}
+
+func TestWatcher_run(t *testing.T) {
+	inner := &FaultyS3{S3: &InMemoryS3{}}
+	c := &ChangeLog{S3: inner, DocumentId: "doc-1"}
+	var errs []error
+	w := &Watcher{ChangeLog: c, MinInterval: time.Hour, C: make(chan []ChangeRef), OnError: func(err error) {
+		errs = append(errs, err)
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+
+	// without the nudge this would only be noticed after an hour
+	AssertEqual(t, c.Append(context.Background(), "peer-a", 1, nil, strings.NewReader("x")), nil)
+	w.Nudge()
+	select {
+	case refs := <-w.C:
+		AssertEqual(t, refs[0].Key, ChangeKey("doc-1", "peer-a", 1))
+	case <-time.After(time.Second):
+		t.Fatal("changes were not delivered")
+	}
+
+	cancel()
+	AssertErrorIs(t, <-done, context.Canceled)
+	AssertEqual(t, len(errs), 0)
+}
+
+func TestWatcher_errors(t *testing.T) {
+	inner := &FaultyS3{S3: &InMemoryS3{}, Rules: []*FaultRule{{Kind: FaultError, Times: 1}}}
+	errs := make(chan error, 1)
+	w := &Watcher{ChangeLog: &ChangeLog{S3: inner, DocumentId: "doc-1"}, MinInterval: time.Millisecond, OnChanges: func([]ChangeRef) {}, OnError: func(err error) {
+		errs <- err
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	AssertErrorIs(t, w.Run(ctx), context.DeadlineExceeded)
+	err := <-errs
+	AssertEqual(t, errors.Is(err, ErrInjectedFault), true)
+}